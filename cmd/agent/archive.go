@@ -0,0 +1,457 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// PathTraversalError occurs when an archive entry points outside of the destination directory
+var PathTraversalError = errors.New("path traversal")
+
+// ArchiveFilter selects the entries of a directory tree that are included in an archive
+type ArchiveFilter struct {
+	Include []string               // Glob patterns of files to include. If empty, all files are included
+	Exclude []string               // Glob patterns of files and directories to exclude
+	Allowed func(path string) bool // Optional access check for each entry
+}
+
+// matchGlob checks if the given slash-separated relative path matches any of the given glob patterns.
+// Patterns without a slash are matched against the base name of the path as well.
+func matchGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(name)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isWithin checks if the given path is equal to or located below the given directory
+func isWithin(dir string, file string) bool {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// WriteArchive writes the file or directory tree at root as tar archive to the given writer.
+// Entry names are relative to root. Entries that cannot be read are skipped.
+func WriteArchive(writer io.Writer, root string, filter ArchiveFilter) error {
+	tw := tar.NewWriter(writer)
+	root = filepath.Clean(root)
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	// A single file is archived by its base name
+	base := root
+	if !info.IsDir() {
+		base = filepath.Dir(root)
+	}
+
+	err = filepath.WalkDir(root, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if file == root {
+				return err
+			}
+			log.Printf("archive: skipping '%s': %s", file, err)
+			return nil
+		}
+		rel, err := filepath.Rel(base, file)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		if matchGlob(filter.Exclude, name) || (filter.Allowed != nil && !filter.Allowed(file)) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// With include filters, directories are created implicitly by the files they contain
+		if entry.IsDir() && len(filter.Include) > 0 {
+			return nil
+		}
+		if !entry.IsDir() && len(filter.Include) > 0 && !matchGlob(filter.Include, name) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			log.Printf("archive: skipping '%s': %s", file, err)
+			return nil
+		}
+		link := ""
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(file); err != nil {
+				log.Printf("archive: skipping '%s': %s", file, err)
+				return nil
+			}
+		case info.Mode().IsDir(), info.Mode().IsRegular():
+		default:
+			// Skip sockets, devices, pipes and other special files
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if !info.Mode().IsRegular() {
+			return tw.WriteHeader(header)
+		}
+		// Open the file before writing the header, so that unreadable files can be skipped
+		f, err := os.Open(file)
+		if err != nil {
+			log.Printf("archive: skipping '%s': %s", file, err)
+			return nil
+		}
+		defer f.Close()
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		// Files might change while being archived. Never write more or less than announced in the header
+		n, err := io.Copy(tw, io.LimitReader(f, header.Size))
+		if err != nil {
+			return err
+		}
+		if n < header.Size {
+			_, err := io.CopyN(tw, zeroReader{}, header.Size-n)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// zeroReader is an infinite source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(buf []byte) (int, error) {
+	clear(buf)
+	return len(buf), nil
+}
+
+// mkdirWithin creates the missing directories of path below the resolved directory dest one level at a time, such that no
+// directory is created outside of dest via symlinks or at paths for which allowed returns false. Returns the resolved path
+func mkdirWithin(dest string, path string, allowed func(path string) bool) (string, error) {
+	rel, err := filepath.Rel(dest, path)
+	if err != nil {
+		return "", err
+	} else if rel == "." {
+		return dest, nil
+	}
+	current := dest
+	for _, element := range strings.Split(rel, string(filepath.Separator)) {
+		next := filepath.Join(current, element)
+		info, err := os.Lstat(next)
+		if errors.Is(err, fs.ErrNotExist) {
+			if allowed != nil && !allowed(next) {
+				return "", PathDeniedError
+			}
+			if err := os.Mkdir(next, 0755); err != nil {
+				return "", err
+			}
+			current = next
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if next, err = filepath.EvalSymlinks(next); err != nil {
+				return "", err
+			} else if !isWithin(dest, next) {
+				return "", PathTraversalError
+			}
+			if info, err = os.Stat(next); err != nil {
+				return "", err
+			}
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("%s: not a directory", next)
+		}
+		current = next
+	}
+	return current, nil
+}
+
+// ExtractArchive extracts the tar archive from the given reader into the directory dest.
+// File modes and symlinks are preserved. Entries that would end up outside of dest are rejected with a PathTraversalError.
+// If allowed is not nil, entries for which it returns false are rejected with a PathDeniedError.
+// Returns the number of extracted entries.
+func ExtractArchive(reader io.Reader, dest string, allowed func(path string) bool) (int, error) {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return 0, err
+	}
+	dest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return 0, err
+	}
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return 0, err
+	}
+
+	extracted := 0
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return extracted, nil
+		} else if err != nil {
+			return extracted, err
+		}
+
+		name := filepath.FromSlash(header.Name)
+		if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+			return extracted, fmt.Errorf("%w: %s", PathTraversalError, header.Name)
+		}
+		target := filepath.Join(dest, name)
+		if !isWithin(dest, target) {
+			return extracted, fmt.Errorf("%w: %s", PathTraversalError, header.Name)
+		}
+		if target == dest {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeSymlink, tar.TypeLink:
+		default:
+			// Skip devices, pipes and other special files
+			continue
+		}
+		// Missing parent directories are created one by one, such that symlinks created by earlier entries or already present
+		// in dest can neither lead outside of dest nor to denied paths
+		resolved, err := mkdirWithin(dest, filepath.Dir(target), allowed)
+		if err != nil {
+			return extracted, fmt.Errorf("%w: %s", err, header.Name)
+		} else if allowed != nil && !allowed(filepath.Join(resolved, filepath.Base(target))) {
+			return extracted, fmt.Errorf("%w: %s", PathDeniedError, header.Name)
+		}
+		// Never follow symlinks or hard links at the target itself. Existing directories are kept
+		if info, err := os.Lstat(target); err == nil && (header.Typeflag != tar.TypeDir || !info.IsDir()) {
+			if err := os.Remove(target); err != nil {
+				return extracted, err
+			}
+		}
+
+		mode := header.FileInfo().Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return extracted, err
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return extracted, err
+			}
+		case tar.TypeReg:
+			file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return extracted, err
+			}
+			if _, err := io.Copy(file, tr); err != nil {
+				file.Close()
+				return extracted, err
+			}
+			if err := file.Close(); err != nil {
+				return extracted, err
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return extracted, err
+			}
+			os.Chtimes(target, header.AccessTime, header.ModTime)
+		case tar.TypeSymlink:
+			// Links are checked against the resolved parent and stored in their cleaned form. Otherwise '..' could step out
+			// of a symlink created by an earlier entry, e.g. 'sub/..' with 'sub -> ../..'
+			link := filepath.FromSlash(header.Linkname)
+			linked := filepath.Join(resolved, link)
+			if filepath.IsAbs(link) || !isWithin(dest, linked) {
+				return extracted, fmt.Errorf("%w: %s -> %s", PathTraversalError, header.Name, header.Linkname)
+			}
+			if real, err := ResolvePath(linked); err != nil {
+				return extracted, err
+			} else if !isWithin(dest, real) {
+				return extracted, fmt.Errorf("%w: %s -> %s", PathTraversalError, header.Name, header.Linkname)
+			}
+			link, err := filepath.Rel(resolved, linked)
+			if err != nil {
+				return extracted, err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return extracted, err
+			}
+		case tar.TypeLink:
+			source := filepath.Join(dest, filepath.FromSlash(header.Linkname))
+			if !isWithin(dest, source) {
+				return extracted, fmt.Errorf("%w: %s -> %s", PathTraversalError, header.Name, header.Linkname)
+			}
+			// The source might be reached via symlinks pointing outside of dest
+			sourceDir, err := filepath.EvalSymlinks(filepath.Dir(source))
+			if err != nil {
+				return extracted, err
+			}
+			source = filepath.Join(sourceDir, filepath.Base(source))
+			if !isWithin(dest, sourceDir) || !isWithin(dest, source) {
+				return extracted, fmt.Errorf("%w: %s -> %s", PathTraversalError, header.Name, header.Linkname)
+			} else if allowed != nil && !allowed(source) {
+				return extracted, fmt.Errorf("%w: %s -> %s", PathDeniedError, header.Name, header.Linkname)
+			}
+			if err := os.Link(source, target); err != nil {
+				return extracted, err
+			}
+		}
+		extracted++
+	}
+}
+
+// getArchiveHandler create a new http handler for pulling directories as tar archive from the host
+func getArchiveHandler(cf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := r.URL.Query()
+		paths := values["path"]
+		if len(paths) <= 0 || paths[0] == "" {
+			writeError(w, http.StatusBadRequest, "missing 'path' argument")
+			return
+		}
+		format := values.Get("format")
+		if format == "" {
+			format = "tar"
+		}
+		if format != "tar" && format != "tar.gz" {
+			writeError(w, http.StatusBadRequest, "invalid format")
+			return
+		}
+		filter := ArchiveFilter{Include: values["include"], Exclude: values["exclude"], Allowed: cf.Webserver.Files.CanRead}
+		for _, pattern := range append(filter.Include, filter.Exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid pattern")
+				return
+			}
+		}
+		root, err := checkReadPath(r, cf, paths[0])
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+		if _, err := os.Stat(root); err != nil {
+			writeFileError(w, err)
+			return
+		}
+
+		filename := filepath.Base(filepath.Clean(paths[0])) + "." + format
+		if format == "tar.gz" {
+			w.Header().Add("Content-Type", "application/gzip")
+		} else {
+			w.Header().Add("Content-Type", "application/x-tar")
+		}
+		w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.WriteHeader(http.StatusOK)
+
+		// Errors can only be logged, as the http status has already been sent
+		var writer io.Writer = w
+		if format == "tar.gz" {
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			writer = gz
+		}
+		if err := WriteArchive(writer, root, filter); err != nil {
+			log.Printf("archive: error while archiving '%s': %s", paths[0], err)
+			return
+		}
+	})
+}
+
+// putArchiveHandler create a new http handler for extracting a pushed tar archive into a directory on the host
+func putArchiveHandler(cf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := r.URL.Query()
+		paths := values["path"]
+		if len(paths) <= 0 || paths[0] == "" {
+			writeError(w, http.StatusBadRequest, "missing 'path' argument")
+			return
+		}
+		if r.Body == nil {
+			writeError(w, http.StatusBadRequest, "missing body")
+			return
+		}
+
+		dest, err := checkWritePath(r, cf, paths[0])
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+		body, err := requestBody(r)
+		if err != nil {
+			if errors.Is(err, UnsupportedEncodingError) {
+				writeError(w, http.StatusUnsupportedMediaType, err.Error())
+			} else {
+				writeError(w, http.StatusBadRequest, err.Error())
+			}
+			return
+		}
+		// Limit the decoded body as well, compressed uploads might expand beyond the limit
+		body = limitBody(w, body, cf)
+		defer body.Close()
+
+		// Detect gzip-compressed archives by their magic bytes
+		var reader io.Reader = bufio.NewReader(body)
+		if magic, _ := reader.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+			gz, err := gzip.NewReader(reader)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			defer gz.Close()
+			reader = gz
+		}
+
+		extracted, err := ExtractArchive(reader, dest, cf.Webserver.Files.CanWrite)
+		if err != nil {
+			reply := ErrorReply{Error: err.Error(), Details: map[string]any{"extracted": extracted}}
+			status := http.StatusInternalServerError
+			if errors.Is(err, PathDeniedError) {
+				status = http.StatusForbidden
+			} else if limited := uploadErrorStatus(err, 0); limited != 0 {
+				status = limited
+			} else if errors.Is(err, PathTraversalError) {
+				status, reply.Code = http.StatusBadRequest, ERR_PATH_TRAVERSAL
+			} else if errors.Is(err, tar.ErrHeader) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, io.ErrUnexpectedEOF) {
+				status = http.StatusBadRequest
+			} else {
+				reply.Code = ERR_IO
+			}
+			writeErrorReply(w, status, reply)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "{\"status\":\"ok\",\"extracted\":%d}", extracted)
+	})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Create a small directory tree for archive tests
+func createArchiveTree(t *testing.T) string {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "sub", "deep"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "messages"), []byte("hello world\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "run.sh"), []byte("#!/bin/sh\ntrue\n"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "zypper.log"), []byte("zypper"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "deep", "core.dump"), []byte("core"), 0644))
+	assert.NoError(t, os.Symlink("messages", filepath.Join(dir, "current")))
+	return dir
+}
+
+// List the entry names of the given tar archive
+func listArchive(t *testing.T, reader io.Reader) map[string]*tar.Header {
+	entries := make(map[string]*tar.Header)
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err, "reading archive should succeed") {
+			break
+		}
+		entries[header.Name] = header
+	}
+	return entries
+}
+
+func TestGetArchive(t *testing.T) {
+	dir := createArchiveTree(t)
+	var cf Config
+	cf.SetDefaults()
+	handler := getArchiveHandler(cf)
+
+	request := func(values url.Values) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/archive?"+values.Encode(), nil))
+		return rec
+	}
+
+	// Full archive
+	rec := request(url.Values{"path": {dir}})
+	assert.Equal(t, http.StatusOK, rec.Code, "archive request should succeed")
+	assert.Equal(t, "application/x-tar", rec.Header().Get("Content-Type"))
+	entries := listArchive(t, rec.Body)
+	assert.Contains(t, entries, "messages")
+	assert.Contains(t, entries, "sub/")
+	assert.Contains(t, entries, "sub/deep/core.dump")
+	if assert.Contains(t, entries, "current") {
+		assert.Equal(t, byte(tar.TypeSymlink), entries["current"].Typeflag, "symlinks should be archived as symlinks")
+		assert.Equal(t, "messages", entries["current"].Linkname)
+	}
+	if assert.Contains(t, entries, "run.sh") {
+		assert.Equal(t, int64(0755), entries["run.sh"].Mode&0777, "file modes should be preserved")
+	}
+
+	// Compressed archive with include and exclude filters
+	rec = request(url.Values{"path": {dir}, "format": {"tar.gz"}, "include": {"*.log", "*.dump"}, "exclude": {"sub/deep"}})
+	assert.Equal(t, http.StatusOK, rec.Code, "compressed archive request should succeed")
+	gz, err := gzip.NewReader(rec.Body)
+	assert.NoError(t, err, "archive should be gzip compressed")
+	entries = listArchive(t, gz)
+	assert.Len(t, entries, 1, "only a single file should match the filters")
+	assert.Contains(t, entries, "sub/zypper.log")
+
+	// Single files
+	rec = request(url.Values{"path": {filepath.Join(dir, "messages")}})
+	assert.Equal(t, http.StatusOK, rec.Code, "archive of single file should succeed")
+	entries = listArchive(t, rec.Body)
+	assert.Len(t, entries, 1)
+	assert.Contains(t, entries, "messages")
+
+	// Denied paths are skipped
+	cf.Webserver.Files.ReadDeny = []string{filepath.Join(dir, "sub")}
+	handler = getArchiveHandler(cf)
+	rec = request(url.Values{"path": {dir}})
+	assert.Equal(t, http.StatusOK, rec.Code, "archive request should succeed")
+	entries = listArchive(t, rec.Body)
+	assert.Contains(t, entries, "messages")
+	assert.NotContains(t, entries, "sub/", "denied directories should be skipped")
+	assert.NotContains(t, entries, "sub/zypper.log", "denied files should be skipped")
+	assert.Equal(t, http.StatusForbidden, request(url.Values{"path": {filepath.Join(dir, "sub")}}).Code, "denied paths should be forbidden")
+
+	// Error handling
+	assert.Equal(t, http.StatusBadRequest, request(url.Values{}).Code, "missing path should be rejected")
+	assert.Equal(t, http.StatusBadRequest, request(url.Values{"path": {dir}, "format": {"zip"}}).Code, "invalid format should be rejected")
+	assert.Equal(t, http.StatusBadRequest, request(url.Values{"path": {dir}, "include": {"[a-"}}).Code, "invalid patterns should be rejected")
+	assert.Equal(t, http.StatusNotFound, request(url.Values{"path": {filepath.Join(dir, "nonexisting")}}).Code, "non-existing paths should return 404")
+}
+
+func TestPutArchive(t *testing.T) {
+	src := createArchiveTree(t)
+	var cf Config
+	cf.SetDefaults()
+	handler := putArchiveHandler(cf)
+
+	request := func(dest string, body io.Reader) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/archive?"+url.Values{"path": {dest}}.Encode(), body))
+		return rec
+	}
+
+	// Roundtrip of a compressed archive
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	assert.NoError(t, WriteArchive(gz, src, ArchiveFilter{}))
+	assert.NoError(t, gz.Close())
+	dest := filepath.Join(t.TempDir(), "extracted")
+	rec := request(dest, &buf)
+	assert.Equal(t, http.StatusOK, rec.Code, "extracting archive should succeed: %s", rec.Body.String())
+	data, err := os.ReadFile(filepath.Join(dest, "sub", "deep", "core.dump"))
+	assert.NoError(t, err, "extracted file should be readable")
+	assert.Equal(t, "core", string(data))
+	info, err := os.Stat(filepath.Join(dest, "run.sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm(), "file modes should be preserved")
+	info, err = os.Stat(filepath.Join(dest, "sub", "zypper.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "file modes should be preserved")
+	link, err := os.Readlink(filepath.Join(dest, "current"))
+	assert.NoError(t, err, "symlinks should be preserved")
+	assert.Equal(t, "messages", link)
+
+	// Path traversal entries must be rejected
+	traversal := func(header tar.Header) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		header.Mode = 0644
+		assert.NoError(t, tw.WriteHeader(&header))
+		if header.Size > 0 {
+			tw.Write(make([]byte, header.Size))
+		}
+		assert.NoError(t, tw.Close())
+		return request(filepath.Join(dest, "traversal"), &buf)
+	}
+	assert.Equal(t, http.StatusBadRequest, traversal(tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Size: 1}).Code, "relative path traversal should be rejected")
+	assert.NoFileExists(t, filepath.Join(dest, "evil"))
+	assert.Equal(t, http.StatusBadRequest, traversal(tar.Header{Name: "/tmp/evil", Typeflag: tar.TypeReg, Size: 1}).Code, "absolute paths should be rejected")
+	assert.Equal(t, http.StatusBadRequest, traversal(tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../../"}).Code, "symlinks pointing outside should be rejected")
+	assert.Equal(t, http.StatusBadRequest, traversal(tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}).Code, "absolute symlinks should be rejected")
+
+	// Invalid archives
+	assert.Equal(t, http.StatusBadRequest, request(filepath.Join(dest, "invalid"), bytes.NewBufferString("this is not a tar archive")).Code, "invalid archives should be rejected")
+}
+
+func TestExtractArchiveLinks(t *testing.T) {
+	outer := t.TempDir()
+	secret := filepath.Join(outer, "secret")
+	assert.NoError(t, os.WriteFile(secret, []byte("original"), 0644))
+	dest := filepath.Join(outer, "target")
+	assert.NoError(t, os.MkdirAll(dest, 0755))
+
+	archive := func(headers ...tar.Header) io.Reader {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, header := range headers {
+			header.Mode = 0755
+			assert.NoError(t, tw.WriteHeader(&header))
+			if header.Size > 0 {
+				tw.Write([]byte("pwned")[:header.Size])
+			}
+		}
+		assert.NoError(t, tw.Close())
+		return &buf
+	}
+	checkSecret := func(msg string) {
+		data, err := os.ReadFile(secret)
+		assert.NoError(t, err)
+		assert.Equal(t, "original", string(data), msg)
+	}
+
+	// Chained symlinks, that only step outside when resolved one after the other
+	_, err := ExtractArchive(archive(
+		tar.Header{Name: "x/y/", Typeflag: tar.TypeDir},
+		tar.Header{Name: "x/y/sub", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		tar.Header{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "x/y/sub/.."},
+		tar.Header{Name: "h", Typeflag: tar.TypeLink, Linkname: "s/secret"},
+		tar.Header{Name: "h", Typeflag: tar.TypeReg, Size: 5},
+	), dest, nil)
+	assert.Error(t, err, "hard links to files outside of the destination should fail")
+	checkSecret("symlink chains must not allow to overwrite files outside of the destination")
+	if resolved, err := filepath.EvalSymlinks(filepath.Join(dest, "s")); assert.NoError(t, err) {
+		realDest, _ := filepath.EvalSymlinks(dest)
+		assert.True(t, isWithin(realDest, resolved), "symlinks should not resolve outside of the destination")
+	}
+
+	// Hard links via existing symlinks pointing outside
+	assert.NoError(t, os.Symlink(outer, filepath.Join(dest, "out")))
+	_, err = ExtractArchive(archive(tar.Header{Name: "h2", Typeflag: tar.TypeLink, Linkname: "out/secret"}), dest, nil)
+	assert.ErrorIs(t, err, PathTraversalError, "hard links via symlinks pointing outside should be rejected")
+
+	// Parent directories must not be created via existing symlinks pointing outside or at denied paths
+	_, err = ExtractArchive(archive(tar.Header{Name: "out/created/file", Typeflag: tar.TypeReg, Size: 5}), dest, nil)
+	assert.ErrorIs(t, err, PathTraversalError, "directories via symlinks pointing outside should be rejected")
+	assert.NoDirExists(t, filepath.Join(outer, "created"), "no directories should be created outside of the destination")
+	denied := func(path string) bool { return !isWithin(filepath.Join(dest, "denied"), path) }
+	_, err = ExtractArchive(archive(tar.Header{Name: "denied/sub/file", Typeflag: tar.TypeReg, Size: 5}), dest, denied)
+	assert.ErrorIs(t, err, PathDeniedError, "directories at denied paths should be rejected")
+	assert.NoDirExists(t, filepath.Join(dest, "denied"), "no directories should be created at denied paths")
+
+	// Regular files must not be written through existing hard links
+	assert.NoError(t, os.Link(secret, filepath.Join(dest, "h3")))
+	_, err = ExtractArchive(archive(tar.Header{Name: "h3", Typeflag: tar.TypeReg, Size: 5}), dest, nil)
+	assert.NoError(t, err)
+	checkSecret("existing hard links should be replaced")
+	data, err := os.ReadFile(filepath.Join(dest, "h3"))
+	assert.NoError(t, err)
+	assert.Equal(t, "pwned", string(data))
+
+	// Directories must not be created through existing symlinks
+	_, err = ExtractArchive(archive(tar.Header{Name: "out", Typeflag: tar.TypeDir}), dest, nil)
+	assert.NoError(t, err)
+	info, err := os.Lstat(filepath.Join(dest, "out"))
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir(), "symlinks should be replaced by directories")
+}
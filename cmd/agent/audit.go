@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord is a single entry of the audit log. Secrets like tokens are never recorded
+type AuditRecord struct {
+	Time       time.Time `json:"time"`               // Start of the request or command
+	Transport  string    `json:"transport"`          // One of http, https or serial
+	Source     string    `json:"source"`             // Source address of http requests or the serial port
+	Identity   string    `json:"identity,omitempty"` // Name of the authenticated identity
+	Auth       string    `json:"auth,omitempty"`     // Authentication method of the identity
+	Method     string    `json:"method,omitempty"`   // http method
+	Endpoint   string    `json:"endpoint"`           // Requested path without query or 'exec' for serial commands
+	Command    string    `json:"cmd,omitempty"`      // Executed command
+	Shell      string    `json:"shell,omitempty"`    // Shell of the executed command
+	UID        *int      `json:"uid,omitempty"`      // User ID of the executed command
+	GID        *int      `json:"gid,omitempty"`      // Group ID of the executed command
+	Paths      []string  `json:"paths,omitempty"`    // Accessed paths on the host
+	Status     int       `json:"status,omitempty"`   // http status code of the reply
+	ReturnCode *int      `json:"ret,omitempty"`      // Return code of the executed command
+	BytesIn    int64     `json:"bytes_in"`           // Bytes received from the client
+	BytesOut   int64     `json:"bytes_out"`          // Bytes sent to the client
+	Duration   int64     `json:"duration"`           // Duration in milliseconds
+	Error      string    `json:"error,omitempty"`    // Reason of rejected or failed commands
+}
+
+// SetIdentity records the authenticated identity
+func (rec *AuditRecord) SetIdentity(identity Identity) {
+	if rec != nil {
+		rec.Identity = identity.Name
+		rec.Auth = identity.Method
+	}
+}
+
+// SetJob records the command, shell and credentials of the given job
+func (rec *AuditRecord) SetJob(job *ExecJob) {
+	if rec != nil {
+		uid, gid := job.UID, job.GID
+		rec.Command = job.Command
+		rec.Shell = job.Shell
+		rec.UID = &uid
+		rec.GID = &gid
+	}
+}
+
+// SetReturnCode records the return code of the executed command
+func (rec *AuditRecord) SetReturnCode(ret int) {
+	if rec != nil {
+		rec.ReturnCode = &ret
+	}
+}
+
+// SetError records the reason of a rejected or failed command
+func (rec *AuditRecord) SetError(err error) {
+	if rec != nil && err != nil {
+		rec.Error = err.Error()
+	}
+}
+
+// AddPath records an accessed path on the host
+func (rec *AuditRecord) AddPath(path string) {
+	if rec != nil {
+		rec.Paths = append(rec.Paths, path)
+	}
+}
+
+// AuditLog writes audit records as json lines to a file and/or syslog
+type AuditLog struct {
+	mutex   sync.Mutex
+	writers []io.Writer
+	closers []io.Closer
+}
+
+// OpenAuditLog opens the audit log as configured. Returns nil, if no audit log is configured
+func OpenAuditLog(cf Audit) (*AuditLog, error) {
+	if cf.File == "" && !cf.Syslog {
+		return nil, nil
+	}
+	audit := &AuditLog{}
+	if cf.File != "" {
+		file, err := os.OpenFile(cf.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		audit.writers = append(audit.writers, file)
+		audit.closers = append(audit.closers, file)
+	}
+	if cf.Syslog {
+		writer, err := openSyslog()
+		if err != nil {
+			audit.Close()
+			return nil, err
+		}
+		audit.writers = append(audit.writers, writer)
+		audit.closers = append(audit.closers, writer)
+	}
+	return audit, nil
+}
+
+// NewAuditLog creates an audit log, that writes to the given writer
+func NewAuditLog(writer io.Writer) *AuditLog {
+	return &AuditLog{writers: []io.Writer{writer}}
+}
+
+// Write appends the given record to the audit log. Errors are logged, but do not fail the audited action
+func (audit *AuditLog) Write(rec *AuditRecord) {
+	if audit == nil {
+		return
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("audit log error: %s", err)
+		return
+	}
+	buf = append(buf, '\n')
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	for _, writer := range audit.writers {
+		if _, err := writer.Write(buf); err != nil {
+			log.Printf("audit log error: %s", err)
+		}
+	}
+}
+
+// Close closes the files of the audit log
+func (audit *AuditLog) Close() error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	var err error
+	for _, closer := range audit.closers {
+		if e := closer.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	audit.closers = nil
+	return err
+}
+
+// Context key of the audit record of a request
+type auditKey struct{}
+
+// requestAudit returns the audit record of the given request or nil, if the request is not audited
+func requestAudit(r *http.Request) *AuditRecord {
+	rec, _ := r.Context().Value(auditKey{}).(*AuditRecord)
+	return rec
+}
+
+// auditWriter counts the bytes and records the status code of a reply
+type auditWriter struct {
+	http.ResponseWriter
+	rec *AuditRecord
+}
+
+func (aw *auditWriter) WriteHeader(code int) {
+	if aw.rec.Status == 0 {
+		aw.rec.Status = code
+	}
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *auditWriter) Write(buf []byte) (int, error) {
+	if aw.rec.Status == 0 {
+		aw.rec.Status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(buf)
+	aw.rec.BytesOut += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to access the underlying http.ResponseWriter
+func (aw *auditWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// auditBody counts the bytes read from a request body
+type auditBody struct {
+	io.ReadCloser
+	rec *AuditRecord
+}
+
+func (ab *auditBody) Read(buf []byte) (int, error) {
+	n, err := ab.ReadCloser.Read(buf)
+	ab.rec.BytesIn += int64(n)
+	return n, err
+}
+
+// auditHandler writes an audit record for each request to the given audit log. The handlers fill in identity, command and paths
+// through the record in the request context. Query parameters are not recorded, as they might contain tokens
+func auditHandler(next http.Handler, audit *AuditLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &AuditRecord{Time: time.Now(), Transport: "http", Source: requestSource(r), Method: r.Method, Endpoint: r.URL.Path}
+		if r.TLS != nil {
+			rec.Transport = "https"
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &auditBody{ReadCloser: r.Body, rec: rec}
+		}
+		defer func() {
+			rec.Duration = time.Since(rec.Time).Milliseconds()
+			audit.Write(rec)
+		}()
+		next.ServeHTTP(&auditWriter{ResponseWriter: w, rec: rec}, r.WithContext(context.WithValue(r.Context(), auditKey{}, rec)))
+	})
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// openSyslog is not supported on Windows. Use an audit log file instead
+func openSyslog() (io.WriteCloser, error) {
+	return nil, fmt.Errorf("syslog is not supported on windows")
+}
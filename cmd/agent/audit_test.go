@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readAuditRecords parses the json lines of an audit log
+func readAuditRecords(t *testing.T, buf *bytes.Buffer) []AuditRecord {
+	records := make([]AuditRecord, 0)
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var rec AuditRecord
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &rec), "audit records should be json lines")
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestAuditRequests(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file")
+	assert.NoError(t, os.WriteFile(filename, []byte("hello audit"), 0644))
+
+	var buf bytes.Buffer
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Token = []Token{{Name: "worker", Token: "secret"}}
+	cf.Webserver.QueryToken = true
+	cf.Audit.Log = NewAuditLog(&buf)
+	mux := http.NewServeMux()
+	registerRoutes(mux, cf)
+
+	request := func(method string, target string, token string, body string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.RemoteAddr = "10.0.0.1:40000"
+		if token != "" {
+			req.Header.Set("Token", token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("POST", "/v1/exec", "secret", `{"cmd":"echo hello","uid":0}`))
+	assert.Equal(t, http.StatusOK, request("GET", "/v1/file?path="+filename, "secret", ""))
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/v1/file?path="+filename, "wrong", ""))
+	assert.Equal(t, http.StatusBadRequest, request("POST", "/v1/exec", "secret", `{"cmd":"true","timeout":-1}`))
+	assert.Equal(t, http.StatusNotFound, request("GET", "/v1/file/tail?path="+filepath.Join(dir, "missing")+"&token=secret", "", ""))
+
+	records := readAuditRecords(t, &buf)
+	assert.Len(t, records, 5, "every request should be audited")
+	assert.NotContains(t, buf.String(), "secret", "tokens must never be audited")
+	if len(records) != 5 {
+		return
+	}
+
+	exec := records[0]
+	assert.Equal(t, "http", exec.Transport)
+	assert.Equal(t, "10.0.0.1", exec.Source)
+	assert.Equal(t, "worker", exec.Identity)
+	assert.Equal(t, AUTH_TOKEN, exec.Auth)
+	assert.Equal(t, "POST", exec.Method)
+	assert.Equal(t, "/v1/exec", exec.Endpoint)
+	assert.Equal(t, "echo hello", exec.Command)
+	if assert.NotNil(t, exec.UID, "the uid should be recorded, also for root") {
+		assert.Equal(t, 0, *exec.UID)
+	}
+	if assert.NotNil(t, exec.ReturnCode) {
+		assert.Equal(t, 0, *exec.ReturnCode)
+	}
+	assert.Equal(t, http.StatusOK, exec.Status)
+	assert.Equal(t, int64(len(`{"cmd":"echo hello","uid":0}`)), exec.BytesIn)
+	assert.Positive(t, exec.BytesOut)
+	assert.False(t, exec.Time.IsZero())
+
+	file := records[1]
+	assert.Equal(t, []string{filename}, file.Paths)
+	assert.Equal(t, int64(len("hello audit")), file.BytesOut)
+	assert.Nil(t, file.UID, "file requests should not record credentials")
+	assert.Nil(t, file.ReturnCode)
+
+	denied := records[2]
+	assert.Equal(t, http.StatusUnauthorized, denied.Status)
+	assert.Empty(t, denied.Identity, "failed authentications have no identity")
+
+	invalid := records[3]
+	assert.Equal(t, http.StatusBadRequest, invalid.Status)
+	assert.Equal(t, "true", invalid.Command, "rejected commands should be audited")
+	assert.Equal(t, "invalid timeout", invalid.Error)
+
+	tail := records[4]
+	assert.Equal(t, "/v1/file/tail", tail.Endpoint, "query parameters should not be recorded")
+	assert.Equal(t, "worker", tail.Identity)
+	assert.Equal(t, http.StatusNotFound, tail.Status)
+}
+
+func TestAuditSerial(t *testing.T) {
+	var buf bytes.Buffer
+	var conf Config
+	conf.SetDefaults()
+	conf.Serial.SerialPort = "/dev/ttyS0"
+	conf.Audit.Log = NewAuditLog(&buf)
+	terminal := NewTerminalEmulator()
+
+	terminal.in.Write([]byte("false\n"))
+	terminal.in.Write([]byte("{\"cmd\":\"true\",\"uid\":-1}\n"))
+	runSerialTerminalAgent(&terminal, conf)
+
+	records := readAuditRecords(t, &buf)
+	if assert.Len(t, records, 2, "every serial command should be audited") {
+		assert.Equal(t, "serial", records[0].Transport)
+		assert.Equal(t, "/dev/ttyS0", records[0].Source)
+		assert.Equal(t, "exec", records[0].Endpoint)
+		assert.Equal(t, "false", records[0].Command)
+		if assert.NotNil(t, records[0].ReturnCode) {
+			assert.Equal(t, 1, *records[0].ReturnCode)
+		}
+		assert.Positive(t, records[0].BytesOut)
+		assert.Equal(t, "invalid uid", records[1].Error)
+	}
+}
+
+func TestOpenAuditLog(t *testing.T) {
+	audit, err := OpenAuditLog(Audit{})
+	assert.NoError(t, err)
+	assert.Nil(t, audit, "no audit log should be opened without configuration")
+	audit.Write(&AuditRecord{Endpoint: "/v1/exec"})
+
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		audit, err := OpenAuditLog(Audit{File: filename})
+		assert.NoError(t, err)
+		audit.Write(&AuditRecord{Endpoint: "/v1/exec"})
+		assert.NoError(t, audit.Close())
+	}
+	buf, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Len(t, readAuditRecords(t, bytes.NewBuffer(buf)), 2, "records should be appended")
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "the audit log should not be world readable")
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Authentication methods of an identity
+const (
+	AUTH_TOKEN       = "token"
+	AUTH_CERTIFICATE = "certificate"
+	AUTH_SIGNATURE   = "signature"
+)
+
+// Realm of the WWW-Authenticate challenge of failed authentications
+const AUTH_REALM = "openqa-agent"
+
+// Name of the query parameter for tokens, if enabled
+const QUERY_TOKEN = "token"
+
+// Scopes of tokens and client certificates. Each authenticated route requires one of them
+const (
+	SCOPE_EXEC       = "exec"       // Run commands
+	SCOPE_FILE_READ  = "file-read"  // Read files and directories
+	SCOPE_FILE_WRITE = "file-write" // Write files and directories, including downloads
+	SCOPE_ADMIN      = "admin"      // Administration of the agent. Implies all other scopes
+)
+
+// All valid scopes
+var scopes = []string{SCOPE_EXEC, SCOPE_FILE_READ, SCOPE_FILE_WRITE, SCOPE_ADMIN}
+
+// PermissionDeniedError occurs when the identity of a request lacks the permissions for the request
+var PermissionDeniedError = errors.New("permission denied")
+
+// Identity is the authenticated client of a request
+type Identity struct {
+	Name        string      // Identity name
+	Method      string      // Authentication method, one of token, signature or certificate
+	Permissions Permissions // Scopes and restrictions of the identity
+}
+
+// SanityCheck checks the permissions for invalid scopes
+func (p *Permissions) SanityCheck() error {
+	for _, scope := range p.Scopes {
+		if !slices.Contains(scopes, scope) {
+			return fmt.Errorf("invalid scope: %s", scope)
+		}
+	}
+	return nil
+}
+
+// HasScope checks if the permissions grant the given scope. Empty scopes grant all scopes, the admin scope implies all other scopes
+func (p *Permissions) HasScope(scope string) bool {
+	return len(p.Scopes) == 0 || slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, SCOPE_ADMIN)
+}
+
+// CheckPath checks if the given resolved path is accessible. Returns a PathDeniedError otherwise
+func (p *Permissions) CheckPath(path string) error {
+	if len(p.Paths) > 0 && !matchPrefixes(p.Paths, path) {
+		return PathDeniedError
+	}
+	return nil
+}
+
+// CheckJob checks if the given command is allowed to run with its user ID. Returns a PermissionDeniedError otherwise
+func (p *Permissions) CheckJob(job *ExecJob) error {
+	if len(p.UIDs) > 0 && !slices.Contains(p.UIDs, job.UID) {
+		return fmt.Errorf("%w: uid %d not allowed", PermissionDeniedError, job.UID)
+	}
+	if len(p.Commands) > 0 {
+		// A shell would allow to run arbitrary commands, e.g. 'ls; rm -rf /'
+		if job.Shell != "" {
+			return fmt.Errorf("%w: restricted commands cannot run in a shell", PermissionDeniedError)
+		}
+		split := CommandSplit(job.Command)
+		if len(split) == 0 || !slices.Contains(p.Commands, split[0]) {
+			return fmt.Errorf("%w: command not allowed", PermissionDeniedError)
+		}
+	}
+	return nil
+}
+
+// Intersect returns the permissions, that are granted by both the permissions and the given other permissions.
+// Returns false, if the restrictions of both have nothing in common
+func (p *Permissions) Intersect(other Permissions) (Permissions, bool) {
+	var result Permissions
+	switch {
+	case len(p.Scopes) == 0 || slices.Contains(p.Scopes, SCOPE_ADMIN):
+		result.Scopes = other.Scopes
+		if len(other.Scopes) == 0 {
+			result.Scopes = p.Scopes
+		}
+	case len(other.Scopes) == 0 || slices.Contains(other.Scopes, SCOPE_ADMIN):
+		result.Scopes = p.Scopes
+	default:
+		for _, scope := range p.Scopes {
+			if slices.Contains(other.Scopes, scope) {
+				result.Scopes = append(result.Scopes, scope)
+			}
+		}
+		if len(result.Scopes) == 0 {
+			return result, false
+		}
+	}
+	result.UIDs = intersect(p.UIDs, other.UIDs)
+	result.Commands = intersect(p.Commands, other.Commands)
+	if (len(p.UIDs) > 0 && len(other.UIDs) > 0 && len(result.UIDs) == 0) || (len(p.Commands) > 0 && len(other.Commands) > 0 && len(result.Commands) == 0) {
+		return result, false
+	}
+	if len(p.Paths) == 0 || len(other.Paths) == 0 {
+		result.Paths = append(slices.Clone(p.Paths), other.Paths...)
+	} else {
+		// The narrower one of nested prefixes remains
+		for _, path := range p.Paths {
+			if matchPrefixes(other.Paths, path) {
+				result.Paths = append(result.Paths, path)
+			}
+		}
+		for _, path := range other.Paths {
+			if matchPrefixes(p.Paths, path) {
+				result.Paths = append(result.Paths, path)
+			}
+		}
+		if len(result.Paths) == 0 {
+			return result, false
+		}
+	}
+	return result, true
+}
+
+// intersect returns the elements contained in both slices. Empty slices do not restrict, so the other slice is returned then
+func intersect[T comparable](a []T, b []T) []T {
+	if len(a) == 0 {
+		return b
+	} else if len(b) == 0 {
+		return a
+	}
+	var result []T
+	for _, value := range a {
+		if slices.Contains(b, value) {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// requestPermissions returns the permissions of the identity of the given request. Requests without identity are not restricted
+func requestPermissions(r *http.Request) Permissions {
+	identity, _ := requestIdentity(r)
+	return identity.Permissions
+}
+
+// checkReadPath resolves the given path and checks if it can be read according to the configuration and the identity of the request
+func checkReadPath(r *http.Request, cf Config, path string) (string, error) {
+	resolved, err := cf.Webserver.Files.CheckReadPath(path)
+	if resolved != "" {
+		requestAudit(r).AddPath(resolved)
+	} else {
+		requestAudit(r).AddPath(path)
+	}
+	if err != nil {
+		return resolved, err
+	}
+	permissions := requestPermissions(r)
+	return resolved, permissions.CheckPath(resolved)
+}
+
+// checkWritePath resolves the given path and checks if it can be written according to the configuration and the identity of the request
+func checkWritePath(r *http.Request, cf Config, path string) (string, error) {
+	resolved, err := cf.Webserver.Files.CheckWritePath(path)
+	if resolved != "" {
+		requestAudit(r).AddPath(resolved)
+	} else {
+		requestAudit(r).AddPath(path)
+	}
+	if err != nil {
+		return resolved, err
+	}
+	permissions := requestPermissions(r)
+	return resolved, permissions.CheckPath(resolved)
+}
+
+// Context key of the identity of a request
+type identityKey struct{}
+
+// requestIdentity returns the authenticated identity of the given request, if any
+func requestIdentity(r *http.Request) (Identity, bool) {
+	identity, ok := r.Context().Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// certificateIdentity returns the identity of the verified client certificate of the given request, if any
+func certificateIdentity(r *http.Request, cf Config) (Identity, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Identity{}, false
+	}
+	return cf.CheckCertificate(r.TLS.VerifiedChains[0][0])
+}
+
+// requestToken returns the token of the given request, either from the first 'Token' header or from the first 'Authorization: Bearer'
+// header. Further tokens are ignored, as each one would need to be verified against all hashed tokens
+func requestToken(r *http.Request) (string, bool) {
+	if tokens := r.Header["Token"]; len(tokens) > 0 {
+		return tokens[0], true
+	}
+	for _, authorization := range r.Header["Authorization"] {
+		scheme, token, found := strings.Cut(strings.TrimSpace(authorization), " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token), true
+		}
+	}
+	return "", false
+}
+
+// queryTokenHandler moves the token from the 'token' query parameter into the 'Token' header for clients that cannot set headers,
+// e.g. browsers on streaming endpoints. The parameter is removed from the request, so that it never shows up in logs.
+func queryTokenHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if !query.Has(QUERY_TOKEN) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.Clone(r.Context())
+		for _, token := range query[QUERY_TOKEN] {
+			r.Header.Add("Token", token)
+		}
+		query.Del(QUERY_TOKEN)
+		r.URL.RawQuery = query.Encode()
+		r.RequestURI = r.URL.RequestURI()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkToken checks the given request for a valid authentication token, request signature or client certificate. Tokens are accepted in the
+// 'Token' header and as 'Authorization: Bearer' header. If not present it rejects the request.
+// If tokens are required in addition to client certificates, both must be valid. The identity of the client is added to the request context.
+// A valid certificate determines the identity and its permissions, also if a token is present.
+// With a rate limiter, failed authentications are logged and delayed, and sources with repeated failures are locked out.
+func checkTokenHandler(next http.Handler, cf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := cf.Webserver.Limiter
+		if limiter != nil {
+			if lockout := limiter.Locked(requestSource(r)); lockout > 0 {
+				writeRateLimited(w, lockout, "too many failed authentications")
+				return
+			}
+		}
+		var tokenIdentity Identity
+		validToken := false
+		token, hasToken := requestToken(r)
+		if hasToken {
+			tokenIdentity, validToken = cf.TokenIdentity(token)
+		}
+		if !validToken {
+			// Signed requests are equivalent to tokens
+			tokenIdentity, validToken = cf.CheckSignature(r)
+			if body, ok := r.Body.(*spooledBody); ok {
+				defer body.Close()
+			}
+		}
+		identity, validCertificate := certificateIdentity(r, cf)
+		authenticated := validToken || validCertificate
+		if cf.Webserver.TLS.RequireToken && cf.Webserver.TLS.ClientCA != "" {
+			authenticated = validToken && validCertificate
+		}
+		if !authenticated {
+			if limiter != nil {
+				if lockout := authFailure(r, limiter); lockout > 0 {
+					writeRateLimited(w, lockout, "too many failed authentications")
+					return
+				}
+			}
+			// Deny request
+			challenge := fmt.Sprintf("Bearer realm=\"%s\"", AUTH_REALM)
+			if hasToken {
+				challenge += ", error=\"invalid_token\""
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			if len(cf.Webserver.SigningKeys) > 0 {
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf("%s realm=\"%s\"", SIGNATURE_SCHEME, AUTH_REALM))
+			}
+			// Legacy clients expect 403
+			if apiVersion(r) == API_LEGACY {
+				writeError(w, http.StatusForbidden, "denied")
+			} else {
+				writeError(w, http.StatusUnauthorized, "denied")
+			}
+			return
+		}
+		permitted := true
+		if !validCertificate {
+			identity = tokenIdentity
+		} else if cf.Webserver.TLS.RequireToken {
+			// Neither credential must grant more than its own permissions
+			identity.Permissions, permitted = identity.Permissions.Intersect(tokenIdentity.Permissions)
+		}
+		if limiter != nil {
+			limiter.Success(requestSource(r))
+		}
+		requestAudit(r).SetIdentity(identity)
+		if !permitted {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("%s: permissions of certificate and token are disjoint", PermissionDeniedError))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+// scopeHandler rejects requests, whose identity lacks the given scope. Must be wrapped by checkTokenHandler
+func scopeHandler(next http.Handler, scope string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		permissions := requestPermissions(r)
+		if scope != "" && !permissions.HasScope(scope) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("%s: missing scope %s", PermissionDeniedError, scope))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// issueCertificate creates a certificate with the given common name, signed by the given parent. Without parent, a CA certificate is created
+func issueCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"openQA"}},
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+func TestCertificateIdentity(t *testing.T) {
+	ca, caKey := issueCertificate(t, "Lab CA", nil, nil)
+	worker, _ := issueCertificate(t, "worker1", ca, caKey)
+	other, _ := issueCertificate(t, "worker2", ca, caKey)
+
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Token = []Token{{Token: "secret"}}
+	cf.Webserver.TLS.ClientCA = "ca.pem"
+
+	var identity Identity
+	request := func(cert *x509.Certificate, token string) int {
+		handler := checkTokenHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, _ = requestIdentity(r)
+		}), cf)
+		identity = Identity{}
+		req := httptest.NewRequest("GET", "/v1/health", nil)
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca}}}
+		}
+		if token != "" {
+			req.Header.Set("Token", token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Without configured clients, every verified certificate is accepted
+	assert.Equal(t, http.StatusOK, request(worker, ""), "verified client certificates should be accepted")
+	assert.Equal(t, Identity{Name: "worker1", Method: AUTH_CERTIFICATE}, identity)
+	assert.Equal(t, http.StatusOK, request(nil, "secret"), "tokens should still be accepted")
+	assert.Equal(t, Identity{Name: AUTH_TOKEN, Method: AUTH_TOKEN}, identity)
+	assert.Equal(t, http.StatusForbidden, request(nil, ""))
+
+	// Configured clients map subjects and fingerprints to identities
+	cf.Webserver.Clients = []Client{{Name: "worker-a", Subject: "CN=worker1,O=openQA"}, {Name: "worker-b", Fingerprint: normalizeFingerprint(CertificateFingerprint(other.Raw))}}
+	assert.Equal(t, http.StatusOK, request(worker, ""))
+	assert.Equal(t, "worker-a", identity.Name, "certificate should be identified by its subject")
+	assert.Equal(t, http.StatusOK, request(other, ""))
+	assert.Equal(t, "worker-b", identity.Name, "certificate should be identified by its fingerprint")
+	cf.Webserver.Clients = []Client{{Name: "worker-a", Subject: "worker1"}}
+	assert.Equal(t, http.StatusOK, request(worker, ""), "common name should match the subject")
+	assert.Equal(t, http.StatusForbidden, request(other, ""), "unmapped certificates should be rejected")
+
+	// Tokens in addition to certificates
+	cf.Webserver.TLS.RequireToken = true
+	assert.Equal(t, http.StatusForbidden, request(worker, ""), "certificate without token should be rejected")
+	assert.Equal(t, http.StatusForbidden, request(nil, "secret"), "token without certificate should be rejected")
+	assert.Equal(t, http.StatusOK, request(worker, "secret"), "certificate and token should be accepted")
+	assert.Equal(t, "worker-a", identity.Name, "certificate identity should take precedence")
+
+	// Certificates must not lift the restrictions of tokens and vice versa
+	cf.Webserver.Clients = nil
+	cf.Webserver.Token = []Token{{Token: "secret", Permissions: Permissions{Scopes: []string{SCOPE_FILE_READ}, UIDs: []int{1000}}}}
+	assert.Equal(t, http.StatusOK, request(worker, "secret"))
+	assert.Equal(t, Permissions{Scopes: []string{SCOPE_FILE_READ}, UIDs: []int{1000}}, identity.Permissions, "restrictions of the token should apply")
+	cf.Webserver.Clients = []Client{{Name: "worker-a", Subject: "worker1", Permissions: Permissions{Scopes: []string{SCOPE_EXEC}}}}
+	assert.Equal(t, http.StatusForbidden, request(worker, "secret"), "disjoint permissions should be rejected")
+}
+
+func TestPermissionsIntersect(t *testing.T) {
+	dir := t.TempDir()
+	all := Permissions{}
+	admin := Permissions{Scopes: []string{SCOPE_ADMIN}}
+	read := Permissions{Scopes: []string{SCOPE_FILE_READ, SCOPE_EXEC}, UIDs: []int{0, 1000}, Paths: []string{dir}}
+	narrow := Permissions{Scopes: []string{SCOPE_EXEC}, UIDs: []int{1000}, Commands: []string{"uname"}, Paths: []string{filepath.Join(dir, "logs")}}
+
+	intersection, ok := all.Intersect(read)
+	assert.True(t, ok)
+	assert.Equal(t, read, intersection, "empty permissions should not restrict")
+	intersection, ok = admin.Intersect(all)
+	assert.True(t, ok)
+	assert.Equal(t, admin, intersection)
+	intersection, ok = read.Intersect(admin)
+	assert.True(t, ok)
+	assert.Equal(t, read, intersection, "the admin scope should not restrict")
+	intersection, ok = read.Intersect(narrow)
+	assert.True(t, ok)
+	assert.Equal(t, narrow, intersection, "the narrower restrictions should remain")
+	_, ok = read.Intersect(Permissions{Scopes: []string{SCOPE_FILE_WRITE}})
+	assert.False(t, ok, "disjoint scopes should be detected")
+	_, ok = read.Intersect(Permissions{UIDs: []int{1}})
+	assert.False(t, ok, "disjoint uids should be detected")
+	_, ok = read.Intersect(Permissions{Paths: []string{dir + "2"}})
+	assert.False(t, ok, "disjoint paths should be detected")
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := issueCertificate(t, "Lab CA", nil, nil)
+	worker, workerKey := issueCertificate(t, "worker1", ca, caKey)
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644))
+
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.TLS = TLS{Cert: filepath.Join(dir, "server.crt"), Key: filepath.Join(dir, "server.key"), ClientCA: caFile}
+	assert.True(t, cf.Webserver.TLS.IsEnabled(), "client ca should enable tls")
+	assert.NoError(t, generateCertificate(cf.Webserver.TLS.Cert, cf.Webserver.TLS.Key))
+	serverConfig, err := cf.Webserver.TLS.TLSConfig()
+	assert.NoError(t, err)
+	server := httptest.NewUnstartedServer(checkTokenHandler(healthHandler(), cf))
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(certificates []tls.Certificate) (int, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certificates}}}
+		res, err := client.Get(server.URL + "/health")
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+	_, err = get(nil)
+	assert.Error(t, err, "connections without client certificate should fail")
+	status, err := get([]tls.Certificate{{Certificate: [][]byte{worker.Raw}, PrivateKey: workerKey}})
+	assert.NoError(t, err, "connections with client certificate should succeed")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestScopes(t *testing.T) {
+	dir := t.TempDir()
+	logs := filepath.Join(dir, "logs")
+	assert.NoError(t, os.MkdirAll(logs, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(logs, "agent.log"), []byte("log"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644))
+
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.BindAddress = "127.0.0.1:8421"
+	cf.Webserver.Token = []Token{
+		{Token: "root"},
+		{Name: "dashboard", Token: "readonly", Permissions: Permissions{Scopes: []string{SCOPE_FILE_READ}, Paths: []string{logs}}},
+		{Name: "runner", Token: "runner", Permissions: Permissions{Scopes: []string{SCOPE_EXEC}, UIDs: []int{1000}, Commands: []string{"true"}}},
+		{Name: "admin", Token: "admin", Permissions: Permissions{Scopes: []string{SCOPE_ADMIN}}},
+	}
+	assert.NoError(t, cf.SanityCheck())
+	mux := http.NewServeMux()
+	registerRoutes(mux, cf)
+
+	request := func(method string, path string, body string, token string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Token", token)
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	get := func(path string, token string) int {
+		return request("GET", "/v1/file?"+url.Values{"path": {path}}.Encode(), "", token)
+	}
+
+	// Tokens without scopes are not restricted
+	assert.Equal(t, http.StatusOK, get(filepath.Join(dir, "secret"), "root"))
+	assert.Equal(t, http.StatusOK, request("POST", "/v1/exec", `{"cmd":"true"}`, "root"))
+
+	// Read-only token limited to a path prefix
+	assert.Equal(t, http.StatusOK, get(filepath.Join(logs, "agent.log"), "readonly"), "reading below the allowed paths should succeed")
+	assert.Equal(t, http.StatusForbidden, get(filepath.Join(dir, "secret"), "readonly"), "reading outside of the allowed paths should be denied")
+	assert.Equal(t, http.StatusForbidden, get(filepath.Join(logs, "..", "secret"), "readonly"), "path traversal should be denied")
+	assert.Equal(t, http.StatusForbidden, request("POST", "/v1/exec", `{"cmd":"true"}`, "readonly"), "exec should require the exec scope")
+	assert.Equal(t, http.StatusForbidden, request("POST", "/v1/file?"+url.Values{"path": {filepath.Join(logs, "new")}}.Encode(), "data", "readonly"), "writing should require the file-write scope")
+	assert.Equal(t, http.StatusOK, request("GET", "/v1/capabilities", "", "readonly"), "capabilities should not require a scope")
+
+	// Exec token limited to UIDs and commands
+	assert.Equal(t, http.StatusForbidden, get(filepath.Join(logs, "agent.log"), "runner"), "reading should require the file-read scope")
+	assert.Equal(t, http.StatusForbidden, request("POST", "/v1/exec", `{"cmd":"true","shell":""}`, "runner"), "commands should be denied for other uids")
+	assert.Equal(t, http.StatusForbidden, request("POST", "/v1/exec", `{"cmd":"false","shell":"","uid":1000}`, "runner"), "commands not on the allowlist should be denied")
+	assert.Equal(t, http.StatusForbidden, request("POST", "/v1/exec", `{"cmd":"true","shell":"bash","uid":1000}`, "runner"), "restricted commands should not run in a shell")
+
+	// Admin scope implies all scopes
+	assert.Equal(t, http.StatusOK, get(filepath.Join(dir, "secret"), "admin"))
+	assert.Equal(t, http.StatusOK, request("POST", "/v1/exec", `{"cmd":"true"}`, "admin"))
+}
+
+func TestPermissions(t *testing.T) {
+	var p Permissions
+	assert.True(t, p.HasScope(SCOPE_EXEC), "empty scopes should grant all scopes")
+	assert.NoError(t, p.CheckPath("/etc/shadow"), "empty paths should allow all paths")
+	assert.NoError(t, p.CheckJob(&ExecJob{Command: "rm -rf /", Shell: "bash"}), "empty restrictions should allow all commands")
+
+	p = Permissions{Scopes: []string{SCOPE_FILE_READ}, Paths: []string{"/var/log"}, UIDs: []int{1000, 1001}, Commands: []string{"/usr/bin/journalctl", "ls"}}
+	assert.True(t, p.HasScope(SCOPE_FILE_READ))
+	assert.False(t, p.HasScope(SCOPE_FILE_WRITE))
+	assert.False(t, p.HasScope(SCOPE_ADMIN))
+	assert.NoError(t, p.CheckPath("/var/log/messages"))
+	assert.ErrorIs(t, p.CheckPath("/var/lib/secret"), PathDeniedError)
+	assert.NoError(t, p.CheckJob(&ExecJob{Command: "/usr/bin/journalctl -b", UID: 1001}))
+	assert.NoError(t, p.CheckJob(&ExecJob{Command: "ls -l /var/log", UID: 1000}))
+	assert.ErrorIs(t, p.CheckJob(&ExecJob{Command: "ls", UID: 0}), PermissionDeniedError, "uid should be restricted")
+	assert.ErrorIs(t, p.CheckJob(&ExecJob{Command: "journalctl", UID: 1000}), PermissionDeniedError, "commands should match exactly")
+	assert.ErrorIs(t, p.CheckJob(&ExecJob{Command: "ls; rm -rf /", Shell: "bash", UID: 1000}), PermissionDeniedError, "shells should be denied")
+
+	p = Permissions{Scopes: []string{"root"}}
+	assert.Error(t, p.SanityCheck(), "invalid scopes should be rejected")
+}
+
+func TestBearerToken(t *testing.T) {
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Token = []Token{{Token: "secret"}}
+	handler := checkTokenHandler(healthHandler(), cf)
+
+	request := func(header string, value string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1/health", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, request("Authorization", "Bearer secret").Code, "bearer tokens should be accepted")
+	assert.Equal(t, http.StatusOK, request("Authorization", "bearer  secret").Code, "the scheme should be case-insensitive")
+	assert.Equal(t, http.StatusOK, request("Token", "secret").Code, "the Token header should still be accepted")
+	assert.Equal(t, http.StatusForbidden, request("Authorization", "Basic secret").Code, "other schemes should be rejected")
+	assert.Equal(t, http.StatusForbidden, request("Authorization", "secret").Code, "tokens without scheme should be rejected")
+
+	rec := request("", "")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, `Bearer realm="openqa-agent"`, rec.Header().Get("WWW-Authenticate"), "failed authentications should carry a challenge")
+	rec = request("Authorization", "Bearer wrong")
+	assert.Equal(t, `Bearer realm="openqa-agent", error="invalid_token"`, rec.Header().Get("WWW-Authenticate"))
+
+	// Only the first token is verified, so that requests cannot trigger many hash verifications
+	req := httptest.NewRequest("GET", "/v1/health", nil)
+	req.Header.Add("Token", "wrong")
+	req.Header.Add("Token", "secret")
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "further tokens should be ignored")
+}
+
+func TestQueryToken(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "log")
+	assert.NoError(t, os.WriteFile(filename, []byte("line\n"), 0644))
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Token = []Token{{Token: "secret"}}
+
+	request := func(path string) int {
+		mux := http.NewServeMux()
+		registerRoutes(mux, cf)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path+"?"+url.Values{"path": {filename}, "token": {"secret"}}.Encode(), nil)
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, request("/v1/file/tail"), "query tokens should require the opt-in")
+	cf.Webserver.QueryToken = true
+	assert.Equal(t, http.StatusOK, request("/v1/file/tail"), "query tokens should be accepted on streaming endpoints")
+	assert.Equal(t, http.StatusUnauthorized, request("/v1/file"), "query tokens should only be accepted on streaming endpoints")
+
+	// The token must be removed from the request
+	var query string
+	handler := queryTokenHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery + " " + r.RequestURI
+		assert.Equal(t, "secret", r.Header.Get("Token"))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/watch?path=%2Ftmp&token=secret", nil))
+	assert.NotContains(t, query, "secret", "query tokens must be redacted")
+	assert.Contains(t, query, "path=%2Ftmp", "other parameters must be kept")
+}
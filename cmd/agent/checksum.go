@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// UnsupportedAlgorithmError occurs when a checksum algorithm is not supported
+var UnsupportedAlgorithmError = errors.New("unsupported checksum algorithm")
+
+// ChecksumMismatchError occurs when data does not match the expected checksum
+var ChecksumMismatchError = errors.New("checksum mismatch")
+
+// Default checksum algorithm
+const DEFAULT_CHECKSUM_ALGORITHM = "sha256"
+
+// Supported checksum algorithms
+var checksumAlgorithms = []string{"sha256", "sha512", "sha1", "md5"}
+
+// newHash creates a new hash for the given checksum algorithm
+func newHash(algo string) (hash.Hash, error) {
+	switch strings.ToLower(algo) {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "md5":
+		return md5.New(), nil
+	default:
+		return nil, UnsupportedAlgorithmError
+	}
+}
+
+// ParseChecksum parses a checksum in the form 'algo:hex', e.g. 'sha256:a948904f...'. Returns the algorithm and the lower-case hex digest
+func ParseChecksum(checksum string) (string, string, error) {
+	algo, sum, found := strings.Cut(checksum, ":")
+	if !found || sum == "" {
+		return "", "", fmt.Errorf("invalid checksum")
+	}
+	if _, err := newHash(algo); err != nil {
+		return "", "", err
+	}
+	return strings.ToLower(algo), strings.ToLower(sum), nil
+}
+
+// FileChecksum computes the hex-encoded checksum of the given file. Returns the checksum and the file size
+func FileChecksum(filename string, algo string) (string, int64, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", 0, err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// ManifestEntry is the checksum of a single file within a directory manifest
+type ManifestEntry struct {
+	Path     string `json:"path"`            // Slash-separated path relative to the directory
+	Checksum string `json:"checksum"`        // Hex-encoded checksum
+	Size     int64  `json:"size"`            // File size in bytes
+	Error    string `json:"error,omitempty"` // Error message, if the file or directory could not be read
+}
+
+// Checksum is the reply object of the checksum endpoint
+type Checksum struct {
+	Path     string          `json:"path"`            // Requested path
+	Algo     string          `json:"algo"`            // Checksum algorithm
+	Checksum string          `json:"checksum"`        // Checksum of the file or of the manifest of a directory
+	Size     int64           `json:"size"`            // File size or total size of all files in a directory
+	Files    []ManifestEntry `json:"files,omitempty"` // Per-file checksums of a directory
+}
+
+// DirectoryManifest computes the checksums of all regular files below the given directory, sorted by their path.
+// Symlinks and special files are not included. If allowed is not nil, files for which it returns false are skipped.
+// Files and directories that cannot be read are included with their error, only failing to read dir itself fails the manifest.
+func DirectoryManifest(dir string, algo string, allowed func(path string) bool) ([]ManifestEntry, error) {
+	manifest := make([]ManifestEntry, 0)
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		rel, relErr := filepath.Rel(dir, file)
+		if relErr != nil {
+			return relErr
+		}
+		if err != nil {
+			if file == dir {
+				return err
+			}
+			manifest = append(manifest, ManifestEntry{Path: filepath.ToSlash(rel), Error: err.Error()})
+			return nil
+		}
+		if allowed != nil && !allowed(file) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		checksum, size, err := FileChecksum(file, algo)
+		if err != nil {
+			manifest = append(manifest, ManifestEntry{Path: filepath.ToSlash(rel), Error: err.Error()})
+			return nil
+		}
+		manifest = append(manifest, ManifestEntry{Path: filepath.ToSlash(rel), Checksum: checksum, Size: size})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(manifest, func(i, j int) bool { return manifest[i].Path < manifest[j].Path })
+	return manifest, nil
+}
+
+// FormatManifest formats the given manifest in the format of sha256sum and similar tools. Entries that could not be read are omitted
+func FormatManifest(manifest []ManifestEntry) string {
+	var builder strings.Builder
+	for _, entry := range manifest {
+		if entry.Error != "" {
+			continue
+		}
+		fmt.Fprintf(&builder, "%s  %s\n", entry.Checksum, entry.Path)
+	}
+	return builder.String()
+}
+
+// checksumHandler create a new http handler for computing checksums of files and directories
+func checksumHandler(cf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := r.URL.Query()
+		paths := values["path"]
+		if len(paths) <= 0 || paths[0] == "" {
+			writeError(w, http.StatusBadRequest, "missing 'path' argument")
+			return
+		}
+		algo := strings.ToLower(values.Get("algo"))
+		if algo == "" {
+			algo = DEFAULT_CHECKSUM_ALGORITHM
+		}
+		if _, err := newHash(algo); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		format := values.Get("format")
+		if format != "" && format != "json" && format != "text" {
+			writeError(w, http.StatusBadRequest, "invalid format")
+			return
+		}
+
+		filename, err := checkReadPath(r, cf, paths[0])
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+
+		checksum := Checksum{Path: paths[0], Algo: algo}
+		if info.IsDir() {
+			checksum.Files, err = DirectoryManifest(filename, algo, cf.Webserver.Files.CanRead)
+			if err == nil {
+				// The checksum of a directory is the checksum of its manifest
+				h, _ := newHash(algo)
+				h.Write([]byte(FormatManifest(checksum.Files)))
+				checksum.Checksum = hex.EncodeToString(h.Sum(nil))
+				for _, entry := range checksum.Files {
+					checksum.Size += entry.Size
+				}
+			}
+		} else {
+			checksum.Checksum, checksum.Size, err = FileChecksum(filename, algo)
+			checksum.Files = []ManifestEntry{{Path: filepath.Base(filename), Checksum: checksum.Checksum, Size: checksum.Size}}
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if format == "text" {
+			w.Header().Add("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, FormatManifest(checksum.Files))
+			return
+		}
+		if !info.IsDir() {
+			checksum.Files = nil
+		}
+		if buf, err := json.Marshal(checksum); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		} else {
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(buf)
+		}
+	})
+}
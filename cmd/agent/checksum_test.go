@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksum(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello world\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "empty"), []byte{}, 0644))
+	assert.NoError(t, os.Symlink("hello.txt", filepath.Join(dir, "link")))
+	var cf Config
+	cf.SetDefaults()
+	handler := checksumHandler(cf)
+
+	request := func(values url.Values) (*httptest.ResponseRecorder, Checksum) {
+		var checksum Checksum
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/checksum?"+values.Encode(), nil))
+		if rec.Code == http.StatusOK && values.Get("format") != "text" {
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &checksum), "parsing checksum should succeed")
+		}
+		return rec, checksum
+	}
+
+	// Reference values computed with sha256sum, sha1sum, md5sum and sha512sum
+	filename := filepath.Join(dir, "hello.txt")
+	rec, checksum := request(url.Values{"path": {filename}})
+	assert.Equal(t, http.StatusOK, rec.Code, "checksum request should succeed")
+	assert.Equal(t, "sha256", checksum.Algo, "sha256 should be the default algorithm")
+	assert.Equal(t, "a948904f2f0f479b8f8197694b30184b0d2ed1c1cd2a1ec0fb85d299a192a447", checksum.Checksum)
+	assert.Equal(t, int64(12), checksum.Size)
+	assert.Empty(t, checksum.Files, "files should only be present for directories")
+	_, checksum = request(url.Values{"path": {filename}, "algo": {"sha1"}})
+	assert.Equal(t, "22596363b3de40b06f981fb85d82312e8c0ed511", checksum.Checksum)
+	_, checksum = request(url.Values{"path": {filename}, "algo": {"md5"}})
+	assert.Equal(t, "6f5902ac237024bdd0c176cb93063dc4", checksum.Checksum)
+	_, checksum = request(url.Values{"path": {filename}, "algo": {"SHA512"}})
+	assert.Equal(t, "db3974a97f2407b7cae1ae637c0030687a11913274d578492558e39c16c017de84eacdc8c62fe34ee4e12b4b1428817f09b6a2760c3f8a664ceae94d2434a593", checksum.Checksum)
+
+	// Directories
+	rec, checksum = request(url.Values{"path": {dir}})
+	assert.Equal(t, http.StatusOK, rec.Code, "directory checksum request should succeed")
+	if assert.Len(t, checksum.Files, 2, "manifest should contain all regular files") {
+		assert.Equal(t, "hello.txt", checksum.Files[0].Path)
+		assert.Equal(t, "a948904f2f0f479b8f8197694b30184b0d2ed1c1cd2a1ec0fb85d299a192a447", checksum.Files[0].Checksum)
+		assert.Equal(t, "sub/empty", checksum.Files[1].Path)
+		assert.Equal(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", checksum.Files[1].Checksum)
+	}
+	assert.Equal(t, int64(12), checksum.Size)
+	_, second := request(url.Values{"path": {dir}})
+	assert.Equal(t, checksum.Checksum, second.Checksum, "directory checksum should be deterministic")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "empty"), []byte("x"), 0644))
+	_, changed := request(url.Values{"path": {dir}})
+	assert.NotEqual(t, checksum.Checksum, changed.Checksum, "directory checksum should change with its contents")
+
+	// sha256sum compatible text manifest
+	rec, _ = request(url.Values{"path": {dir}, "format": {"text"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "a948904f2f0f479b8f8197694b30184b0d2ed1c1cd2a1ec0fb85d299a192a447  hello.txt\n")
+
+	// Error handling
+	rec, _ = request(url.Values{})
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "missing path should be rejected")
+	rec, _ = request(url.Values{"path": {filename}, "algo": {"crc32"}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "unsupported algorithms should be rejected")
+	rec, _ = request(url.Values{"path": {filepath.Join(dir, "nonexisting")}})
+	assert.Equal(t, http.StatusNotFound, rec.Code, "non-existing files should return 404")
+}
+
+func TestDirectoryManifestErrors(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "good"), []byte("hello world\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "vanished"), []byte("gone"), 0644))
+	// Remove the file after it has been listed, as permissions don't make files unreadable for root
+	vanish := func(path string) bool {
+		if filepath.Base(path) == "vanished" {
+			os.Remove(path)
+		}
+		return true
+	}
+
+	manifest, err := DirectoryManifest(dir, "sha256", vanish)
+	assert.NoError(t, err, "unreadable files should not fail the manifest")
+	if assert.Len(t, manifest, 2) {
+		assert.Equal(t, "good", manifest[0].Path)
+		assert.Empty(t, manifest[0].Error)
+		assert.Equal(t, "vanished", manifest[1].Path)
+		assert.NotEmpty(t, manifest[1].Error, "unreadable files should be reported")
+		assert.Empty(t, manifest[1].Checksum)
+	}
+	assert.Equal(t, "a948904f2f0f479b8f8197694b30184b0d2ed1c1cd2a1ec0fb85d299a192a447  good\n", FormatManifest(manifest), "unreadable files should not be part of the manifest")
+
+	_, err = DirectoryManifest(filepath.Join(dir, "nonexisting"), "sha256", nil)
+	assert.Error(t, err, "unreadable directories should fail")
+}
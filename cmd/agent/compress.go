@@ -0,0 +1,157 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// UnsupportedEncodingError occurs when a request body is encoded with an unsupported Content-Encoding
+var UnsupportedEncodingError = errors.New("unsupported content encoding")
+
+// Supported content encodings in order of preference
+var supportedEncodings = []string{"zstd", "gzip"}
+
+// negotiateEncoding selects the preferred supported encoding from the given Accept-Encoding header.
+// Returns an empty string if the response should not be compressed.
+func negotiateEncoding(header string) string {
+	weights := make(map[string]float64)
+	for _, item := range strings.Split(header, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, params, _ := strings.Cut(item, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		weights[name] = q
+	}
+	best := ""
+	bestQ := 0.0
+	for _, encoding := range supportedEncodings {
+		q, ok := weights[encoding]
+		if !ok {
+			// The wildcard matches all encodings not explicitly listed
+			q = weights["*"]
+		}
+		// Equal weights keep the first match in order of preference
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressWriter is a http.ResponseWriter that compresses the response body with the given encoding
+type compressWriter struct {
+	http.ResponseWriter
+	request     *http.Request
+	encoding    string         // Negotiated content encoding
+	encoder     io.WriteCloser // Encoder or nil, if the response is passed through uncompressed
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	header := cw.Header()
+	header.Add("Vary", "Accept-Encoding")
+	// Don't compress responses without body, already encoded responses or compressed archives
+	contentType := header.Get("Content-Type")
+	if cw.request.Method == http.MethodHead || code < 200 || code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent ||
+		header.Get("Content-Encoding") != "" || contentType == "application/gzip" || contentType == "application/zstd" {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	header.Set("Content-Encoding", cw.encoding)
+	header.Del("Content-Length")
+	// The compressed representation is not byte-identical to the original one
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	switch cw.encoding {
+	case "zstd":
+		encoder, _ := zstd.NewWriter(cw.ResponseWriter, zstd.WithEncoderConcurrency(1))
+		cw.encoder = encoder
+	default:
+		cw.encoder = gzip.NewWriter(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(buf []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(buf)
+	}
+	return cw.ResponseWriter.Write(buf)
+}
+
+// Flush writes all pending compressed data to the client
+func (cw *compressWriter) Flush() {
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap allows http.ResponseController to access the underlying http.ResponseWriter
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Close terminates the compressed stream
+func (cw *compressWriter) Close() error {
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	return nil
+}
+
+// compressHandler compresses the responses of the given handler according to the Accept-Encoding header of the request.
+// Range requests are never compressed, as ranges refer to the uncompressed content.
+func compressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, request: r, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// requestBody returns a reader for the decoded body of the given request, according to its Content-Encoding header
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r.Body)
+	case "zstd":
+		decoder, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, UnsupportedEncodingError
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	assert.Equal(t, "", negotiateEncoding(""), "no Accept-Encoding should not compress")
+	assert.Equal(t, "", negotiateEncoding("identity"), "identity should not compress")
+	assert.Equal(t, "", negotiateEncoding("br, deflate"), "unsupported encodings should not compress")
+	assert.Equal(t, "gzip", negotiateEncoding("gzip"))
+	assert.Equal(t, "zstd", negotiateEncoding("zstd"))
+	assert.Equal(t, "zstd", negotiateEncoding("gzip, deflate, br, zstd"), "zstd should be preferred on equal weights")
+	assert.Equal(t, "gzip", negotiateEncoding("gzip;q=1.0, zstd;q=0.5"), "weights should be respected")
+	assert.Equal(t, "zstd", negotiateEncoding("*"))
+	assert.Equal(t, "gzip", negotiateEncoding("zstd;q=0, *"), "refused encodings should not be selected via wildcard")
+	assert.Equal(t, "", negotiateEncoding("gzip;q=0"), "refused encodings should not be selected")
+}
+
+func TestCompressHandler(t *testing.T) {
+	content := strings.Repeat("kernel: hello world\n", 1000)
+	filename := filepath.Join(t.TempDir(), "messages")
+	assert.NoError(t, os.WriteFile(filename, []byte(content), 0644))
+	var cf Config
+	cf.SetDefaults()
+	handler := compressHandler(getFileHandler(cf))
+
+	request := func(header http.Header) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/file?"+url.Values{"path": {filename}}.Encode(), nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		handler.ServeHTTP(rec, withAPIVersion(req, API_V1))
+		return rec
+	}
+
+	// Uncompressed
+	rec := request(nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "response without Accept-Encoding should not be compressed")
+	assert.Equal(t, content, rec.Body.String())
+
+	// gzip
+	rec = request(http.Header{"Accept-Encoding": {"gzip"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Empty(t, rec.Header().Get("Content-Length"), "Content-Length of compressed responses should be removed")
+	assert.Less(t, rec.Body.Len(), len(content), "compressed response should be smaller")
+	gz, err := gzip.NewReader(rec.Body)
+	assert.NoError(t, err, "response should be gzip compressed")
+	data, err := io.ReadAll(gz)
+	assert.NoError(t, err, "decompressing response should succeed")
+	assert.Equal(t, content, string(data))
+
+	// zstd
+	rec = request(http.Header{"Accept-Encoding": {"zstd"}})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "zstd", rec.Header().Get("Content-Encoding"))
+	decoder, err := zstd.NewReader(rec.Body)
+	assert.NoError(t, err, "response should be zstd compressed")
+	data, err = io.ReadAll(decoder)
+	assert.NoError(t, err, "decompressing response should succeed")
+	assert.Equal(t, content, string(data))
+
+	// Range requests are not compressed
+	rec = request(http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-5"}})
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "range requests should not be compressed")
+	assert.Equal(t, content[:6], rec.Body.String())
+}
+
+func TestCompressedUpload(t *testing.T) {
+	content := strings.Repeat("fixture\n", 100)
+	filename := filepath.Join(t.TempDir(), "fixture")
+	var cf Config
+	cf.SetDefaults()
+	handler := putFileHandler(cf)
+
+	upload := func(encoding string, body io.Reader) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/file?"+url.Values{"path": {filename}}.Encode(), body)
+		req.Header.Set("Content-Encoding", encoding)
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(content))
+	gz.Close()
+	rec := upload("gzip", &buf)
+	assert.Equal(t, http.StatusAccepted, rec.Code, "gzip compressed upload should succeed")
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data), "uploaded file should be decompressed")
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, upload("br", strings.NewReader(content)).Code, "unsupported encodings should be rejected")
+	assert.Equal(t, http.StatusBadRequest, upload("gzip", strings.NewReader(content)).Code, "invalid compressed data should be rejected")
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -14,14 +18,78 @@ type Config struct {
 	Webserver      Webserver `yaml:"webserver"` // Webserver configuration
 	Discovery      Discovery `yaml:"discovery"` // Discovery configuration
 	Serial         Serial    `yaml:"serial"`    // Serial port configuration
+	Audit          Audit     `yaml:"audit"`     // Audit log of requests and commands
+	Policy         Policy    `yaml:"policy"`    // Restrictions of the commands, that can be executed
 	DefaultShell   string    `yaml:"shell"`     // Optional argument to run each command in this shell by default
 	DefaultWorkDir string    `yaml:"workdir"`   // Default work dir for commands to be executed
 
 }
 
 type Webserver struct {
-	Token       []Token `yaml:"token"` // Accepted authentication token
-	BindAddress string  `yaml:"bind"`  // Address the webserver binds to
+	Token         []Token      `yaml:"token"`          // Accepted authentication token
+	BindAddress   string       `yaml:"bind"`           // Address the webserver binds to
+	Files         FileAccess   `yaml:"files"`          // Path restrictions for the file API
+	MaxUploadSize int64        `yaml:"max_upload"`     // Maximum size in bytes of data written to the host per request. 0 means unlimited
+	TLS           TLS          `yaml:"tls"`            // HTTPS configuration
+	Clients       []Client     `yaml:"clients"`        // Identities of client certificates, if client certificates are verified
+	TokenState    string       `yaml:"token_state"`    // File to persist tokens created at runtime in. If empty, they are lost on restart
+	QueryToken    bool         `yaml:"query_token"`    // Accept the token as 'token' query parameter on streaming endpoints, for clients that cannot set headers
+	SigningKeys   []SigningKey `yaml:"signing_keys"`   // Shared keys for HMAC request signatures
+	SignatureSkew int64        `yaml:"signature_skew"` // Maximum clock skew in seconds of signed requests. Defaults to 300
+	RateLimit     RateLimit    `yaml:"rate_limit"`     // Rate limits and lockout after failed authentications
+
+	Tokens  *TokenStore  `yaml:"-"` // Tokens created at runtime, shared between all copies of the configuration
+	Limiter *RateLimiter `yaml:"-"` // State of the rate limits, shared between all copies of the configuration. No limits apply without it
+}
+
+// RateLimit configures rate limits of the webserver and the lockout of sources after repeated failed authentications
+type RateLimit struct {
+	PerSource     Limit            `yaml:"per_source"`     // Limit of all requests per source address
+	Endpoints     map[string]Limit `yaml:"endpoints"`      // Global limits of expensive endpoints by path, e.g. '/exec'
+	MaxFailures   int              `yaml:"max_failures"`   // Failed authentications per source address within the failure window until lockout. 0 disables the lockout
+	FailureWindow int64            `yaml:"failure_window"` // Window in seconds for counting failed authentications
+	Lockout       int64            `yaml:"lockout"`        // Duration of the lockout in seconds
+}
+
+// Limit is a rate limit with bursts
+type Limit struct {
+	Rate  float64 `yaml:"rate"`  // Requests per second. 0 means unlimited
+	Burst int     `yaml:"burst"` // Maximum number of requests at once. Defaults to the rate, but at least 1
+}
+
+// TLS configures HTTPS for the webserver
+type TLS struct {
+	Enabled      bool   `yaml:"enabled"`       // Serve HTTPS instead of HTTP. Implied if a certificate is configured
+	Cert         string `yaml:"cert"`          // Certificate (chain) PEM file. If empty, a self-signed certificate is generated and persisted
+	Key          string `yaml:"key"`           // Private key PEM file
+	MinVersion   string `yaml:"min_version"`   // Minimum TLS version, one of 1.0, 1.1, 1.2 or 1.3. Defaults to 1.2
+	ClientCA     string `yaml:"client_ca"`     // CA bundle PEM file. If set, clients must present a certificate signed by one of the CAs
+	RequireToken bool   `yaml:"require_token"` // Require a valid token in addition to a client certificate
+}
+
+// Client maps a client certificate to an identity. A certificate matches, if either its subject or its fingerprint match
+type Client struct {
+	Name        string      `yaml:"name"`        // Identity name
+	Subject     string      `yaml:"subject"`     // Certificate subject, either the common name or the full distinguished name, e.g. 'CN=worker1,O=openQA'
+	Fingerprint string      `yaml:"fingerprint"` // SHA-256 fingerprint of the certificate in the form 'sha256:hex'
+	Permissions Permissions `yaml:",inline"`     // Scopes and restrictions of the client
+}
+
+// Permissions restrict what a token or client certificate is allowed to do. Empty fields impose no restrictions
+type Permissions struct {
+	Scopes   []string `yaml:"scopes"`   // Allowed scopes, see SCOPE_*. Empty means all scopes
+	UIDs     []int    `yaml:"uids"`     // User IDs commands are allowed to run as
+	Paths    []string `yaml:"paths"`    // Path prefixes accessible via the file API, in addition to the global path restrictions
+	Commands []string `yaml:"commands"` // Executables that are allowed to run. Commands must not run in a shell then
+}
+
+// FileAccess restricts the paths that are accessible via the file API.
+// Entries are path prefixes. Deny rules take precedence over allow rules. Empty allow rules allow all paths.
+type FileAccess struct {
+	ReadAllow  []string `yaml:"read_allow"`  // Path prefixes that can be read
+	ReadDeny   []string `yaml:"read_deny"`   // Path prefixes that must never be read
+	WriteAllow []string `yaml:"write_allow"` // Path prefixes that can be written
+	WriteDeny  []string `yaml:"write_deny"`  // Path prefixes that must never be written
 }
 
 type Discovery struct {
@@ -29,28 +97,82 @@ type Discovery struct {
 	DiscoveryToken   string `yaml:"token"` // Unique token for the discovery service, if present
 }
 
+// Policy restricts the commands, that can be executed via the REST API and the serial terminal. Empty lists do not restrict
+type Policy struct {
+	Allow         []string `yaml:"allow"`          // Allowed executables. Entries without path separator match only commands without path
+	Deny          []string `yaml:"deny"`           // Denied executables. Entries without path separator match the executable in any directory
+	AllowPatterns []string `yaml:"allow_patterns"` // Regular expressions, of which one must match the whole command
+	DenyPatterns  []string `yaml:"deny_patterns"`  // Regular expressions, of which none may match the whole command
+	Shells        []string `yaml:"shells"`         // Allowed shells. Commands without shell are always allowed
+	UIDs          []int    `yaml:"uids"`           // Allowed user IDs
+	GIDs          []int    `yaml:"gids"`           // Allowed group IDs
+	MaxTimeout    int64    `yaml:"max_timeout"`    // Maximum timeout in seconds. 0 means unlimited
+	Env           []string `yaml:"env"`            // Names of environment variables, that jobs may set while the policy restricts anything
+}
+
+// Audit configures the audit log, that records every request and serial command as json line
+type Audit struct {
+	File   string `yaml:"file"`   // Append audit records to this file
+	Syslog bool   `yaml:"syslog"` // Send audit records to the local syslog (Linux only)
+
+	Log *AuditLog `yaml:"-"` // Opened audit log, shared between all copies of the configuration. Nothing is audited without it
+}
+
 type Serial struct {
 	SerialPort string `yaml:"port"`       // Serial Port where the agent should run on. Format: DEVICE[:BAUD]
 	Serialized bool   `yaml:"serialized"` // Terminate result object with a \n
 }
 
-// Authentication token object
+// SigningKey is a shared key for HMAC request signatures. Exactly one of Key, File or Env must be set
+type SigningKey struct {
+	ID          string      `yaml:"id"`      // Key identifier, sent by the client along with the signature
+	Name        string      `yaml:"name"`    // Optional identity name. Defaults to the key identifier
+	Key         string      `yaml:"key"`     // Shared secret
+	File        string      `yaml:"file"`    // File containing the shared secret
+	Env         string      `yaml:"env"`     // Environment variable containing the shared secret
+	Permissions Permissions `yaml:",inline"` // Scopes and restrictions of the key
+}
+
+// Authentication token object. Exactly one of Token, Hash, File or Env must be set
 type Token struct {
-	Token string // Actual secret
+	Name        string      `yaml:"name"`                 // Optional identity name
+	Token       string      `yaml:"token"`                // Actual secret
+	Hash        string      `yaml:"hash"`                 // Salted hash of the secret, as generated by 'openqa-agent hash-token'
+	File        string      `yaml:"file"`                 // File containing the secret
+	Env         string      `yaml:"env"`                  // Environment variable containing the secret
+	NotBefore   time.Time   `yaml:"not_before,omitempty"` // Optional time from which on the token is valid
+	Expires     time.Time   `yaml:"expires,omitempty"`    // Optional expiry time of the token
+	Permissions Permissions `yaml:",inline"`              // Scopes and restrictions of the token
 }
 
+// PathDeniedError occurs when a path is not accessible due to the configured path restrictions
+var PathDeniedError = errors.New("access to path denied")
+
 // Singleton program configuration
 var config Config
 
 func (cf *Config) SetDefaults() {
 	cf.Webserver.Token = make([]Token, 0)
 	cf.Webserver.BindAddress = ""
+	cf.Webserver.Files = FileAccess{}
+	cf.Webserver.MaxUploadSize = 0
+	cf.Webserver.TLS = TLS{}
+	cf.Webserver.Clients = make([]Client, 0)
+	cf.Webserver.TokenState = ""
+	cf.Webserver.QueryToken = false
+	cf.Webserver.SigningKeys = make([]SigningKey, 0)
+	cf.Webserver.SignatureSkew = 0
+	cf.Webserver.RateLimit = RateLimit{MaxFailures: 10, FailureWindow: 60, Lockout: 300}
+	cf.Webserver.Limiter = nil
+	cf.Webserver.Tokens = nil
 	cf.DefaultShell = ""
 	cf.DefaultWorkDir = ""
 	cf.Discovery.DiscoveryAddress = ""
 	cf.Discovery.DiscoveryToken = ""
 	cf.Serial.SerialPort = ""
 	cf.Serial.Serialized = true
+	cf.Audit = Audit{}
+	cf.Policy = Policy{}
 }
 
 // Parse program arguments and apply settings to the config instance
@@ -113,27 +235,258 @@ func (cf *Config) LoadDefaultConfig() error {
 	return cf.LoadYaml(DEFAULT_CONFIG_PATH)
 }
 
+// loadSecret reads a secret from the given file or environment variable
+func loadSecret(file string, env string) (string, error) {
+	if file != "" {
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		secret := strings.TrimSpace(string(buf))
+		if secret == "" {
+			return "", fmt.Errorf("file %s is empty", file)
+		}
+		return secret, nil
+	}
+	secret := strings.TrimSpace(os.Getenv(env))
+	if secret == "" {
+		return "", fmt.Errorf("environment variable %s is empty or not set", env)
+	}
+	return secret, nil
+}
+
+// LoadTokens reads the secrets of tokens and signing keys from files and environment variables
+func (cf *Config) LoadTokens() error {
+	for i := range cf.Webserver.Token {
+		tok := &cf.Webserver.Token[i]
+		if tok.File == "" && tok.Env == "" {
+			continue
+		}
+		if tok.Token != "" {
+			return fmt.Errorf("token %d: only one of token, hash, file or env can be set", i+1)
+		}
+		secret, err := loadSecret(tok.File, tok.Env)
+		if err != nil {
+			return fmt.Errorf("token %d: %w", i+1, err)
+		}
+		tok.Token = secret
+	}
+	for i := range cf.Webserver.SigningKeys {
+		key := &cf.Webserver.SigningKeys[i]
+		if key.File == "" && key.Env == "" {
+			continue
+		}
+		if key.Key != "" {
+			return fmt.Errorf("signing key %s: only one of key, file or env can be set", key.ID)
+		}
+		secret, err := loadSecret(key.File, key.Env)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %w", key.ID, err)
+		}
+		key.Key = secret
+	}
+	return nil
+}
+
 // Perform sanity checks on the config and return errors find
 func (cf *Config) SanityCheck() error {
-	if cf.Webserver.BindAddress != "" && len(cf.Webserver.Token) == 0 {
-		return fmt.Errorf("no access tokens for webserver")
+	if cf.Webserver.BindAddress != "" && len(cf.Webserver.Token) == 0 && len(cf.Webserver.SigningKeys) == 0 && cf.Webserver.TLS.ClientCA == "" {
+		return fmt.Errorf("no access tokens, signing keys or client ca for webserver")
+	}
+	if cf.Webserver.TLS.RequireToken && len(cf.Webserver.Token) == 0 && len(cf.Webserver.SigningKeys) == 0 {
+		return fmt.Errorf("tokens required but none defined")
 	}
 	if cf.Webserver.BindAddress == "" && cf.Serial.SerialPort == "" {
 		return fmt.Errorf("neither serial nor webserver defined")
 	}
+	if err := cf.Policy.SanityCheck(); err != nil {
+		return fmt.Errorf("policy: %w", err)
+	}
+	if len(cf.Policy.Allow) > 0 && cf.DefaultShell != "" {
+		return fmt.Errorf("policy: allowed executables cannot be combined with a default shell")
+	}
+	if (cf.Webserver.TLS.Cert == "") != (cf.Webserver.TLS.Key == "") {
+		return fmt.Errorf("tls certificate and key must be given together")
+	}
+	if _, err := parseTLSVersion(cf.Webserver.TLS.MinVersion); err != nil {
+		return err
+	}
+	for i, tok := range cf.Webserver.Token {
+		sources := 0
+		for _, source := range []string{tok.Hash, tok.File, tok.Env} {
+			if source != "" {
+				sources++
+			}
+		}
+		// Secrets from files and environment variables are loaded into Token
+		if sources > 1 || (tok.Hash != "" && tok.Token != "") {
+			return fmt.Errorf("token %d: only one of token, hash, file or env can be set", i+1)
+		}
+		if sources == 0 && tok.Token == "" {
+			return fmt.Errorf("token %d: empty token", i+1)
+		}
+		if tok.Hash != "" {
+			if _, err := ParseTokenHash(tok.Hash); err != nil {
+				return fmt.Errorf("token %d: %w", i+1, err)
+			}
+		}
+		if err := tok.Permissions.SanityCheck(); err != nil {
+			return fmt.Errorf("token %d: %w", i+1, err)
+		}
+		if !tok.Expires.IsZero() && !tok.NotBefore.IsZero() && !tok.NotBefore.Before(tok.Expires) {
+			return fmt.Errorf("token %d: not_before must be before expires", i+1)
+		}
+	}
+	for _, client := range cf.Webserver.Clients {
+		if err := client.Permissions.SanityCheck(); err != nil {
+			return fmt.Errorf("client %s: %w", client.Name, err)
+		}
+	}
+	ids := make(map[string]bool)
+	for _, key := range cf.Webserver.SigningKeys {
+		if key.ID == "" {
+			return fmt.Errorf("signing key without id")
+		}
+		if ids[key.ID] {
+			return fmt.Errorf("signing key %s: duplicate id", key.ID)
+		}
+		ids[key.ID] = true
+		if key.Key == "" && key.File == "" && key.Env == "" {
+			return fmt.Errorf("signing key %s: empty key", key.ID)
+		}
+		if err := key.Permissions.SanityCheck(); err != nil {
+			return fmt.Errorf("signing key %s: %w", key.ID, err)
+		}
+	}
+	if cf.Webserver.SignatureSkew < 0 {
+		return fmt.Errorf("invalid signature_skew")
+	}
+	if err := cf.Webserver.RateLimit.SanityCheck(); err != nil {
+		return err
+	}
 	return nil
 }
 
-// CheckToken checks if the given token is allowed by the configuration
+// IsValid checks if the token is valid at the given time, i.e. not expired and not before its validity
+func (tok *Token) IsValid(now time.Time) bool {
+	if !tok.NotBefore.IsZero() && now.Before(tok.NotBefore) {
+		return false
+	}
+	return tok.Expires.IsZero() || now.Before(tok.Expires)
+}
+
+// CheckToken checks if the given token is allowed by the configuration. All comparisons are constant-time
 func (cf *Config) CheckToken(token string) bool {
+	_, ok := cf.TokenIdentity(token)
+	return ok
+}
+
+// TokenIdentity returns the identity of the given token, if it is allowed by the configuration or the runtime tokens and currently valid.
+// Unnamed tokens are identified as 'token'
+func (cf *Config) TokenIdentity(token string) (Identity, bool) {
 	if token == "" {
-		return false
+		return Identity{}, false
 	}
+	now := time.Now()
 	for _, tok := range cf.Webserver.Token {
-		// Additional check: Do not ever allow an empty token, even accidentally
-		if tok.Token != "" && tok.Token == token {
+		if !tok.IsValid(now) {
+			continue
+		}
+		valid := false
+		if tok.Hash != "" {
+			valid = VerifyTokenHash(token, tok.Hash)
+		} else {
+			// Additional check: Do not ever allow an empty token, even accidentally
+			valid = tok.Token != "" && compareTokens(tok.Token, token)
+		}
+		if valid {
+			name := tok.Name
+			if name == "" {
+				name = AUTH_TOKEN
+			}
+			return Identity{Name: name, Method: AUTH_TOKEN, Permissions: tok.Permissions}, true
+		}
+	}
+	if cf.Webserver.Tokens != nil {
+		return cf.Webserver.Tokens.Identity(token)
+	}
+	return Identity{}, false
+}
+
+// CheckCertificate checks if the given verified client certificate maps to an identity. Without configured clients, every verified
+// certificate is accepted and identified by its common name.
+func (cf *Config) CheckCertificate(cert *x509.Certificate) (Identity, bool) {
+	if len(cf.Webserver.Clients) == 0 {
+		return Identity{Name: cert.Subject.CommonName, Method: AUTH_CERTIFICATE}, true
+	}
+	fingerprint := CertificateFingerprint(cert.Raw)
+	for _, client := range cf.Webserver.Clients {
+		if client.Fingerprint != "" && normalizeFingerprint(client.Fingerprint) == fingerprint {
+			return Identity{Name: client.Name, Method: AUTH_CERTIFICATE, Permissions: client.Permissions}, true
+		}
+		if client.Subject != "" && (client.Subject == cert.Subject.String() || client.Subject == cert.Subject.CommonName) {
+			return Identity{Name: client.Name, Method: AUTH_CERTIFICATE, Permissions: client.Permissions}, true
+		}
+	}
+	return Identity{}, false
+}
+
+// matchPrefixes checks if the given resolved path is located below any of the given path prefixes
+func matchPrefixes(prefixes []string, path string) bool {
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			continue
+		}
+		// Prefixes might contain symlinks as well, e.g. /var/run -> /run
+		resolved, err := ResolvePath(prefix)
+		if err != nil {
+			resolved = filepath.Clean(prefix)
+		}
+		if isWithin(resolved, path) {
 			return true
 		}
 	}
 	return false
 }
+
+// CanRead checks if the given resolved path is allowed to be read
+func (fa *FileAccess) CanRead(path string) bool {
+	if matchPrefixes(fa.ReadDeny, path) {
+		return false
+	}
+	return len(fa.ReadAllow) == 0 || matchPrefixes(fa.ReadAllow, path)
+}
+
+// CanWrite checks if the given resolved path is allowed to be written
+func (fa *FileAccess) CanWrite(path string) bool {
+	if matchPrefixes(fa.WriteDeny, path) {
+		return false
+	}
+	return len(fa.WriteAllow) == 0 || matchPrefixes(fa.WriteAllow, path)
+}
+
+// CheckReadPath resolves the given path and checks if it is allowed to be read.
+// Returns the resolved path or a PathDeniedError
+func (fa *FileAccess) CheckReadPath(path string) (string, error) {
+	resolved, err := ResolvePath(path)
+	if err != nil {
+		return "", err
+	}
+	if !fa.CanRead(resolved) {
+		return resolved, PathDeniedError
+	}
+	return resolved, nil
+}
+
+// CheckWritePath resolves the given path and checks if it is allowed to be written.
+// Returns the resolved path or a PathDeniedError
+func (fa *FileAccess) CheckWritePath(path string) (string, error) {
+	resolved, err := ResolvePath(path)
+	if err != nil {
+		return "", err
+	}
+	if !fa.CanWrite(resolved) {
+		return resolved, PathDeniedError
+	}
+	return resolved, nil
+}
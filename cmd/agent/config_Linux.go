@@ -5,6 +5,13 @@ package main
 
 const DEFAULT_CONFIG_PATH = "/etc/openqa/openqa-agent.yaml"
 
+// Location of the generated self-signed certificate, if TLS is enabled without a certificate
+const DEFAULT_TLS_CERT = "/etc/openqa/openqa-agent.crt"
+const DEFAULT_TLS_KEY = "/etc/openqa/openqa-agent.key"
+
+// Shell commands run in by default
+const DEFAULT_SHELL = ""
+
 // Apply system-specific default settings, if any
 func (cf *Config) SetSystemDefaults() {
 }
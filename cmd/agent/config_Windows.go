@@ -5,9 +5,16 @@ package main
 
 const DEFAULT_CONFIG_PATH = "C:\\Program Files\\openqa-agent.yaml"
 
+// Location of the generated self-signed certificate, if TLS is enabled without a certificate
+const DEFAULT_TLS_CERT = "C:\\Program Files\\openqa-agent.crt"
+const DEFAULT_TLS_KEY = "C:\\Program Files\\openqa-agent.key"
+
+// Shell commands run in by default
+const DEFAULT_SHELL = "powershell"
+
 // Apply system-specific default settings, if any
 func (cf *Config) SetSystemDefaults() {
-	cf.DefaultShell = "powershell"
+	cf.DefaultShell = DEFAULT_SHELL
 	cf.DefaultWorkDir = "C:\\"
 	cf.Serial.SerialPort = "COM1:9600,None,8,one"
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -43,6 +45,12 @@ func TestSanityCheck(t *testing.T) {
 	assert.NoError(t, cf.SanityCheck(), "sanity checks should pass with webserver on")
 	cf.Serial.SerialPort = "/dev/ttyS0:115200"
 	assert.NoError(t, cf.SanityCheck(), "sanity checks should pass with webserver and serial port on")
+	cf.Webserver.TLS.Cert = "/etc/openqa/agent.crt"
+	assert.Error(t, cf.SanityCheck(), "sanity check must fail with tls certificate but no key")
+	cf.Webserver.TLS.Key = "/etc/openqa/agent.key"
+	assert.NoError(t, cf.SanityCheck(), "sanity checks should pass with tls certificate and key")
+	cf.Webserver.TLS.MinVersion = "2.0"
+	assert.Error(t, cf.SanityCheck(), "sanity check must fail with invalid tls version")
 }
 
 func TestYaml(t *testing.T) {
@@ -66,3 +74,51 @@ func TestYaml(t *testing.T) {
 	assert.Equal(t, "/dev/ttyS0,115200", cf.Serial.SerialPort)
 	assert.True(t, cf.Serial.Serialized)
 }
+
+func TestFileAccess(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "logs"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "secret"), 0755))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "secret"), filepath.Join(dir, "logs", "link")))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "secret", "newfile"), filepath.Join(dir, "logs", "dangling")))
+	assert.NoError(t, os.Symlink(filepath.Join("..", "secret", "other"), filepath.Join(dir, "logs", "relative")))
+
+	var fa FileAccess
+	// Empty rules allow everything
+	_, err = fa.CheckReadPath(filepath.Join(dir, "secret", "shadow"))
+	assert.NoError(t, err, "empty rules should allow reading")
+	_, err = fa.CheckWritePath(filepath.Join(dir, "secret", "shadow"))
+	assert.NoError(t, err, "empty rules should allow writing")
+
+	fa.ReadAllow = []string{dir}
+	fa.ReadDeny = []string{filepath.Join(dir, "secret")}
+	fa.WriteAllow = []string{filepath.Join(dir, "logs")}
+	resolved, err := fa.CheckReadPath(filepath.Join(dir, "logs", "messages"))
+	assert.NoError(t, err, "reading allowed path should succeed")
+	assert.Equal(t, filepath.Join(dir, "logs", "messages"), resolved)
+	_, err = fa.CheckReadPath(filepath.Join(dir, "secret", "shadow"))
+	assert.ErrorIs(t, err, PathDeniedError, "reading denied path should fail")
+	_, err = fa.CheckReadPath(filepath.Join(dir, "logs", "..", "secret", "shadow"))
+	assert.ErrorIs(t, err, PathDeniedError, "'..' elements should be resolved")
+	resolved, err = fa.CheckReadPath(filepath.Join(dir, "logs", "link", "shadow"))
+	assert.ErrorIs(t, err, PathDeniedError, "symlinks should be resolved")
+	assert.Equal(t, filepath.Join(dir, "secret", "shadow"), resolved)
+	_, err = fa.CheckReadPath(dir + "2")
+	assert.ErrorIs(t, err, PathDeniedError, "prefixes should only match whole path elements")
+	_, err = fa.CheckWritePath(filepath.Join(dir, "logs", "new", "file"))
+	assert.NoError(t, err, "writing allowed path should succeed")
+	_, err = fa.CheckWritePath(filepath.Join(dir, "logs", "link", "file"))
+	assert.ErrorIs(t, err, PathDeniedError, "writing via symlinks outside allowed paths should fail")
+	_, err = fa.CheckWritePath(filepath.Join(dir, "file"))
+	assert.ErrorIs(t, err, PathDeniedError, "writing outside allowed paths should fail")
+	resolved, err = fa.CheckWritePath(filepath.Join(dir, "logs", "dangling"))
+	assert.ErrorIs(t, err, PathDeniedError, "writing via dangling symlinks outside allowed paths should fail")
+	assert.Equal(t, filepath.Join(dir, "secret", "newfile"), resolved, "dangling symlinks should be resolved")
+	resolved, err = fa.CheckWritePath(filepath.Join(dir, "logs", "relative"))
+	assert.ErrorIs(t, err, PathDeniedError, "writing via relative dangling symlinks outside allowed paths should fail")
+	assert.Equal(t, filepath.Join(dir, "secret", "other"), resolved)
+	assert.NoError(t, os.Symlink("loop", filepath.Join(dir, "logs", "loop")))
+	_, err = fa.CheckWritePath(filepath.Join(dir, "logs", "loop"))
+	assert.Error(t, err, "symlink loops should fail")
+}
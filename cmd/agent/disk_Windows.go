@@ -0,0 +1,39 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// freeSpace returns the number of bytes available to the current user on the volume of the given path
+func freeSpace(path string) (uint64, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
+
+// isDiskFull checks if the given error is caused by a full volume
+func isDiskFull(err error) bool {
+	return errors.Is(err, windows.ERROR_DISK_FULL) || errors.Is(err, windows.ERROR_HANDLE_DISK_FULL)
+}
+
+// chownLike is a no-op on Windows, where overwritten files inherit the permissions of their directory
+func chownLike(path string, info os.FileInfo) error {
+	return nil
+}
+
+// linkCount returns the number of hard links of the file with the given info. Not available on Windows
+func linkCount(info os.FileInfo) uint64 {
+	return 1
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+)
+
+// Machine-readable error codes of error replies. The codes are stable, clients should branch on them and not on the error messages
+const (
+	ERR_INVALID_REQUEST        = "invalid_request"        // Missing or invalid arguments
+	ERR_INVALID_JOB            = "invalid_job"            // Malformed job object or job failed the sanity checks
+	ERR_UNSUPPORTED_VERSION    = "unsupported_version"    // Requested API version is not supported
+	ERR_DENIED                 = "denied"                 // Invalid token or access denied by the configuration
+	ERR_NOT_FOUND              = "not_found"              // File, directory or job does not exist
+	ERR_TIMEOUT                = "timeout"                // Command or download ran into its timeout
+	ERR_CANCELED               = "canceled"               // Job has been cancelled
+	ERR_EXEC_FAILED            = "exec_failed"            // Command could not be run
+	ERR_TOO_LARGE              = "too_large"              // Upload or download exceeds the size limit
+	ERR_INSUFFICIENT_STORAGE   = "insufficient_storage"   // Not enough free space on the target filesystem
+	ERR_UNSUPPORTED_MEDIA_TYPE = "unsupported_media_type" // Unsupported Content-Type or Content-Encoding
+	ERR_RANGE_NOT_SATISFIABLE  = "range_not_satisfiable"  // Offset beyond the end of file
+	ERR_CHECKSUM_MISMATCH      = "checksum_mismatch"      // Data does not match the expected checksum
+	ERR_PATH_TRAVERSAL         = "path_traversal"         // Archive entry pointing outside of the destination
+	ERR_UPSTREAM               = "upstream_error"         // Remote server failed or replied with an error
+	ERR_RECEIVE_FAILED         = "receive_failed"         // Request body could not be received, e.g. client disconnected
+	ERR_IO                     = "io_error"               // Reading or writing a file on the host failed
+	ERR_RATE_LIMITED           = "rate_limited"           // Too many requests or failed authentications, retry later
+	ERR_INTERNAL               = "internal"               // Any other error
+)
+
+// ErrorReply is the reply object of all failed requests
+type ErrorReply struct {
+	Code    string         `json:"code"`              // Machine-readable error code
+	Error   string         `json:"error"`             // Human-readable error message
+	Details map[string]any `json:"details,omitempty"` // Additional information, depending on the error
+}
+
+// errorCode returns the default error code for the given http status
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ERR_INVALID_REQUEST
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return ERR_DENIED
+	case http.StatusNotFound:
+		return ERR_NOT_FOUND
+	case http.StatusRequestEntityTooLarge:
+		return ERR_TOO_LARGE
+	case http.StatusUnsupportedMediaType:
+		return ERR_UNSUPPORTED_MEDIA_TYPE
+	case http.StatusRequestedRangeNotSatisfiable:
+		return ERR_RANGE_NOT_SATISFIABLE
+	case http.StatusUnprocessableEntity:
+		return ERR_CHECKSUM_MISMATCH
+	case http.StatusBadGateway:
+		return ERR_UPSTREAM
+	case http.StatusGatewayTimeout, 524:
+		return ERR_TIMEOUT
+	case http.StatusInsufficientStorage:
+		return ERR_INSUFFICIENT_STORAGE
+	case http.StatusTooManyRequests:
+		return ERR_RATE_LIMITED
+	default:
+		return ERR_INTERNAL
+	}
+}
+
+// writeError writes an error reply with the default error code of the given http status
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeErrorReply(w, status, ErrorReply{Error: message})
+}
+
+// writeErrorReply writes the given error reply. If the reply has no code, the default code of the http status is used
+func writeErrorReply(w http.ResponseWriter, status int, reply ErrorReply) {
+	if reply.Code == "" {
+		reply.Code = errorCode(status)
+	}
+	buf, err := json.Marshal(reply)
+	if err != nil {
+		// Only happens with details that cannot be encoded
+		status = http.StatusInternalServerError
+		buf, _ = json.Marshal(ErrorReply{Code: ERR_INTERNAL, Error: err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+// writeFileError writes the error reply for errors while accessing a path, e.g. from CheckReadPath or os.Open
+func writeFileError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, PathDeniedError):
+		writeError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, fs.ErrNotExist):
+		writeError(w, http.StatusNotFound, "file not found")
+	default:
+		writeErrorReply(w, http.StatusInternalServerError, ErrorReply{Code: ERR_IO, Error: err.Error()})
+	}
+}
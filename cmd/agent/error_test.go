@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) ErrorReply {
+	var reply ErrorReply
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reply), "error reply must be valid json: %s", rec.Body.String())
+	return reply
+}
+
+func TestWriteError(t *testing.T) {
+	// Windows paths and quotes must be escaped
+	message := "open C:\\Users\\\"geeko\"\\file.txt: access denied"
+	rec := httptest.NewRecorder()
+	writeError(rec, http.StatusBadRequest, message)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	reply := decodeError(t, rec)
+	assert.Equal(t, ERR_INVALID_REQUEST, reply.Code, "code should default to the one of the status")
+	assert.Equal(t, message, reply.Error)
+	assert.Nil(t, reply.Details)
+
+	rec = httptest.NewRecorder()
+	writeErrorReply(rec, http.StatusBadRequest, ErrorReply{Code: ERR_INVALID_JOB, Error: "no command", Details: map[string]any{"field": "cmd"}})
+	reply = decodeError(t, rec)
+	assert.Equal(t, ERR_INVALID_JOB, reply.Code)
+	assert.Equal(t, "cmd", reply.Details["field"])
+
+	// Error codes of file errors
+	for _, test := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{PathDeniedError, http.StatusForbidden, ERR_DENIED},
+		{fmt.Errorf("open: %w", os.ErrNotExist), http.StatusNotFound, ERR_NOT_FOUND},
+		{os.ErrClosed, http.StatusInternalServerError, ERR_IO},
+	} {
+		rec = httptest.NewRecorder()
+		writeFileError(rec, test.err)
+		assert.Equal(t, test.status, rec.Code, "status of '%s'", test.err)
+		assert.Equal(t, test.code, decodeError(t, rec).Code, "code of '%s'", test.err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Token = []Token{{Token: "secret"}}
+
+	rec := httptest.NewRecorder()
+	checkTokenHandler(dummyHandler(), cf).ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, ERR_DENIED, decodeError(t, rec).Code)
+
+	rec = httptest.NewRecorder()
+	execHandler(cf).ServeHTTP(rec, httptest.NewRequest("POST", "/exec", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, ERR_INVALID_JOB, decodeError(t, rec).Code, "empty exec job should be an invalid job")
+
+	rec = httptest.NewRecorder()
+	getFileHandler(cf).ServeHTTP(rec, httptest.NewRequest("GET", "/file?path=/nonexisting/file", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, ERR_NOT_FOUND, decodeError(t, rec).Code)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os/exec"
+	"sync"
 	"time"
 )
 
@@ -94,12 +95,20 @@ func (job *ExecJob) exec() error {
 	if err != nil {
 		return err
 	}
-	go ReadPipe(stdoutPipe, &stdout, MAX_BUFFER)
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
 		return err
 	}
-	go ReadPipe(stderrPipe, &stderr, MAX_BUFFER)
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		ReadPipe(stdoutPipe, &stdout, MAX_BUFFER)
+		readers.Done()
+	}()
+	go func() {
+		ReadPipe(stderrPipe, &stderr, MAX_BUFFER)
+		readers.Done()
+	}()
 
 	// Run command
 	job.runtime = time.Now().UnixMilli()
@@ -117,6 +126,8 @@ func (job *ExecJob) exec() error {
 		timeout <- true
 	}()
 	go func() {
+		// All reads from the pipes must be completed before calling Wait
+		readers.Wait()
 		err := cmd.Wait()
 		completed <- err
 	}()
@@ -128,6 +139,10 @@ func (job *ExecJob) exec() error {
 			ret = nil // Don't tread failed commands as program errors
 		case <-timeout:
 			cmd.Process.Kill()
+			// Child processes might still hold the pipes open. Close them to unblock the readers
+			stdoutPipe.Close()
+			stderrPipe.Close()
+			<-completed
 			ret = TimeoutError
 			running = false
 		}
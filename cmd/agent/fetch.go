@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// SizeLimitError occurs when a download exceeds the size limit
+var SizeLimitError = errors.New("size limit exceeded")
+
+// UpstreamError occurs when the remote server replies with an error
+var UpstreamError = errors.New("upstream error")
+
+// Time after which finished asynchronous fetch jobs are discarded
+const FETCH_JOB_RETENTION = 1 * time.Hour
+
+// FetchJob contains all information about downloading a URL onto the host
+type FetchJob struct {
+	URL      string            `json:"url"`      // URL to be downloaded
+	Path     string            `json:"path"`     // Destination path
+	Checksum string            `json:"checksum"` // Optional expected checksum in the form 'algo:hex', e.g. 'sha256:a948904f...'
+	MaxSize  int64             `json:"max_size"` // Optional size limit in bytes
+	Timeout  int64             `json:"timeout"`  // Timeout in seconds until the download is abandoned
+	Headers  map[string]string `json:"headers"`  // Additional http headers for the request
+	Async    bool              `json:"async"`    // Run the download in the background and return immediately
+
+	mutex    sync.Mutex
+	id       string    // Job identifier for asynchronous jobs
+	state    string    // One of running, completed or failed
+	received int64     // Number of bytes received so far
+	size     int64     // Expected size from the Content-Length header or -1 if unknown
+	err      error     // Error of a failed job
+	started  time.Time // Time when the job started
+	finished time.Time // Time when the job finished
+	cancel   context.CancelFunc
+}
+
+// FetchStatus is the reply object of the fetch endpoint
+type FetchStatus struct {
+	ID       string `json:"id,omitempty"`    // Job identifier of asynchronous jobs
+	URL      string `json:"url"`             // Downloaded URL
+	Path     string `json:"path"`            // Destination path
+	State    string `json:"state"`           // One of running, completed or failed
+	Received int64  `json:"received"`        // Number of bytes received so far
+	Size     int64  `json:"size"`            // Expected size or -1 if unknown
+	Runtime  int64  `json:"runtime"`         // Runtime of the download in milliseconds
+	Error    string `json:"error,omitempty"` // Error message of failed jobs
+	Code     string `json:"code,omitempty"`  // Error code of failed jobs
+}
+
+// Apply default settings on the job object
+func (job *FetchJob) SetDefaults() {
+	job.Timeout = 300
+	job.MaxSize = 0
+	job.Headers = make(map[string]string)
+	job.Async = false
+	job.state = "running"
+	job.size = -1
+}
+
+// Perform sanity checks on the job object
+func (job *FetchJob) SanityCheck() error {
+	if job.URL == "" {
+		return fmt.Errorf("no url")
+	}
+	if u, err := url.Parse(job.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url")
+	}
+	if job.Path == "" {
+		return fmt.Errorf("no path")
+	}
+	if job.Timeout <= 0 {
+		return fmt.Errorf("invalid timeout")
+	}
+	if job.MaxSize < 0 {
+		return fmt.Errorf("invalid max_size")
+	}
+	if job.Checksum != "" {
+		if _, _, err := ParseChecksum(job.Checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status returns a snapshot of the current job status
+func (job *FetchJob) Status() FetchStatus {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	status := FetchStatus{ID: job.id, URL: job.URL, Path: job.Path, State: job.state, Received: job.received, Size: job.size}
+	if job.started.IsZero() {
+		status.Runtime = 0
+	} else if job.finished.IsZero() {
+		status.Runtime = time.Since(job.started).Milliseconds()
+	} else {
+		status.Runtime = job.finished.Sub(job.started).Milliseconds()
+	}
+	if job.err != nil {
+		status.Error = job.err.Error()
+		if errors.Is(job.err, context.Canceled) {
+			status.Code = ERR_CANCELED
+		} else {
+			status.Code = errorCode(fetchStatusCode(job.err))
+		}
+	}
+	return status
+}
+
+// Write counts the received bytes for progress reporting and enforces the size limit
+func (job *FetchJob) Write(buf []byte) (int, error) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.received += int64(len(buf))
+	if job.MaxSize > 0 && job.received > job.MaxSize {
+		return 0, SizeLimitError
+	}
+	return len(buf), nil
+}
+
+// fetch downloads the URL into a temporary file next to the destination path and moves it into place once completed
+func (job *FetchJob) fetch(ctx context.Context) error {
+	job.mutex.Lock()
+	job.started = time.Now()
+	job.mutex.Unlock()
+	err := job.download(ctx)
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.finished = time.Now()
+	job.err = err
+	if err != nil {
+		job.state = "failed"
+	} else {
+		job.state = "completed"
+		job.size = job.received
+	}
+	return err
+}
+
+func (job *FetchJob) download(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(job.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", job.URL, nil)
+	if err != nil {
+		return err
+	}
+	for key, value := range job.Headers {
+		req.Header.Set(key, value)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return TimeoutError
+		}
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%w: %s", UpstreamError, res.Status)
+	}
+	if res.ContentLength >= 0 {
+		if job.MaxSize > 0 && res.ContentLength > job.MaxSize {
+			return SizeLimitError
+		}
+		if err := checkFreeSpace(job.Path, res.ContentLength); err != nil {
+			return err
+		}
+		job.mutex.Lock()
+		job.size = res.ContentLength
+		job.mutex.Unlock()
+	}
+
+	// Count the received bytes for progress reporting
+	_, err = WriteFileAtomic(job.Path, io.TeeReader(res.Body, job), 0644, job.Checksum)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return TimeoutError
+	}
+	return err
+}
+
+// Registry of asynchronous fetch jobs
+var fetchJobs = struct {
+	mutex sync.Mutex
+	jobs  map[string]*FetchJob
+}{jobs: make(map[string]*FetchJob)}
+
+// registerFetchJob assigns a new identifier to the given job and adds it to the registry.
+// Finished jobs that exceeded the retention time are discarded.
+func registerFetchJob(job *FetchJob) error {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	job.id = hex.EncodeToString(buf)
+	fetchJobs.mutex.Lock()
+	defer fetchJobs.mutex.Unlock()
+	for id, other := range fetchJobs.jobs {
+		other.mutex.Lock()
+		expired := !other.finished.IsZero() && time.Since(other.finished) > FETCH_JOB_RETENTION
+		other.mutex.Unlock()
+		if expired {
+			delete(fetchJobs.jobs, id)
+		}
+	}
+	fetchJobs.jobs[job.id] = job
+	return nil
+}
+
+// fetchStatusCode returns the http status code for the given fetch error
+func fetchStatusCode(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, TimeoutError):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, SizeLimitError):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, InsufficientStorageError), isDiskFull(err):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ChecksumMismatchError):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, os.ErrPermission):
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// writeFetchStatus writes the given fetch status as json object
+func writeFetchStatus(w http.ResponseWriter, code int, status FetchStatus) {
+	if buf, err := json.Marshal(status); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+	} else {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write(buf)
+	}
+}
+
+// fetchHandler create a new http handler for downloading a URL onto the host
+func fetchHandler(cf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		job := &FetchJob{}
+		job.SetDefaults()
+		if err := json.NewDecoder(r.Body).Decode(job); err != nil {
+			writeErrorReply(w, http.StatusBadRequest, ErrorReply{Code: ERR_INVALID_JOB, Error: err.Error()})
+			return
+		}
+		if err := job.SanityCheck(); err != nil {
+			writeErrorReply(w, http.StatusBadRequest, ErrorReply{Code: ERR_INVALID_JOB, Error: err.Error()})
+			return
+		}
+		path, err := checkWritePath(r, cf, job.Path)
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+		job.Path = path
+		// Downloads onto the host are subject to the upload size limit as well
+		if max := cf.Webserver.MaxUploadSize; max > 0 && (job.MaxSize == 0 || job.MaxSize > max) {
+			job.MaxSize = max
+		}
+
+		if !job.Async {
+			err := job.fetch(r.Context())
+			writeFetchStatus(w, fetchStatusCode(err), job.Status())
+			return
+		}
+
+		// Asynchronous jobs must not be bound to the request context. The job must be complete, before it is visible in the registry
+		ctx, cancel := context.WithCancel(context.Background())
+		job.cancel = cancel
+		if err := registerFetchJob(job); err != nil {
+			cancel()
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		go func() {
+			defer cancel()
+			job.fetch(ctx)
+		}()
+		location := "/fetch/" + job.id
+		if apiVersion(r) >= API_V1 {
+			location = API_V1_PREFIX + location
+		}
+		w.Header().Add("Location", location)
+		writeFetchStatus(w, http.StatusAccepted, job.Status())
+	})
+}
+
+// fetchStatusHandler create a new http handler for querying or cancelling asynchronous fetch jobs
+func fetchStatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetchJobs.mutex.Lock()
+		job, ok := fetchJobs.jobs[r.PathValue("id")]
+		fetchJobs.mutex.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "job not found")
+			return
+		}
+		if r.Method == http.MethodDelete {
+			job.cancel()
+		}
+		writeFetchStatus(w, http.StatusOK, job.Status())
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetch(t *testing.T) {
+	content := strings.Repeat("openQA asset\n", 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/asset.qcow2":
+			w.Write([]byte(content))
+		case "/private":
+			if r.Header.Get("Authorization") != "Bearer s3cr3t" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("private"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	var cf Config
+	cf.SetDefaults()
+	handler := fetchHandler(cf)
+
+	request := func(job map[string]any) (*httptest.ResponseRecorder, FetchStatus) {
+		var status FetchStatus
+		body, err := json.Marshal(job)
+		assert.NoError(t, err)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/fetch", bytes.NewBuffer(body)))
+		json.Unmarshal(rec.Body.Bytes(), &status)
+		return rec, status
+	}
+
+	// Synchronous download with checksum
+	filename := filepath.Join(dir, "asset.qcow2")
+	checksum, _, err := FileChecksum(writeTempFile(t, content), "sha256")
+	assert.NoError(t, err)
+	rec, status := request(map[string]any{"url": upstream.URL + "/asset.qcow2", "path": filename, "checksum": "sha256:" + checksum})
+	assert.Equal(t, http.StatusOK, rec.Code, "fetch should succeed: %s", rec.Body.String())
+	assert.Equal(t, "completed", status.State)
+	assert.Equal(t, int64(len(content)), status.Received)
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(data), "downloaded file should match")
+
+	// Custom headers
+	rec, _ = request(map[string]any{"url": upstream.URL + "/private", "path": filepath.Join(dir, "private"), "headers": map[string]string{"Authorization": "Bearer s3cr3t"}})
+	assert.Equal(t, http.StatusOK, rec.Code, "fetch with custom headers should succeed")
+
+	// Failures must not leave any files behind
+	rec, status = request(map[string]any{"url": upstream.URL + "/asset.qcow2", "path": filepath.Join(dir, "mismatch"), "checksum": "sha256:0000"})
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "checksum mismatch should fail")
+	assert.Equal(t, "failed", status.State)
+	rec, _ = request(map[string]any{"url": upstream.URL + "/asset.qcow2", "path": filepath.Join(dir, "toolarge"), "max_size": 100})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, "size limit should be enforced")
+	rec, _ = request(map[string]any{"url": upstream.URL + "/nonexisting", "path": filepath.Join(dir, "nonexisting")})
+	assert.Equal(t, http.StatusBadGateway, rec.Code, "upstream errors should fail")
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2, "failed downloads should be cleaned up")
+
+	// Invalid jobs
+	rec, _ = request(map[string]any{"url": "ftp://example.com/file", "path": filepath.Join(dir, "ftp")})
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "unsupported schemes should be rejected")
+	rec, _ = request(map[string]any{"url": upstream.URL + "/asset.qcow2"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "missing path should be rejected")
+	rec, _ = request(map[string]any{"url": upstream.URL + "/asset.qcow2", "path": filename, "checksum": "crc32:1234"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "unsupported checksum algorithms should be rejected")
+
+	// Asynchronous download
+	filename = filepath.Join(dir, "async.qcow2")
+	rec, status = request(map[string]any{"url": upstream.URL + "/asset.qcow2", "path": filename, "async": true})
+	assert.Equal(t, http.StatusAccepted, rec.Code, "async fetch should be accepted")
+	assert.NotEmpty(t, status.ID, "async jobs should have an id")
+	assert.Equal(t, "/fetch/"+status.ID, rec.Header().Get("Location"))
+	req := httptest.NewRequest("POST", "/fetch", strings.NewReader(`{"url":"`+upstream.URL+`/asset.qcow2","path":"`+filepath.Join(dir, "v1.qcow2")+`","async":true}`))
+	rec = httptest.NewRecorder()
+	fetchHandler(cf).ServeHTTP(rec, withAPIVersion(req, API_V1))
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	var v1 FetchStatus
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &v1))
+	assert.Equal(t, API_V1_PREFIX+"/fetch/"+v1.ID, rec.Header().Get("Location"), "version 1 requests should get versioned locations")
+	sm := http.NewServeMux()
+	sm.Handle("GET /fetch/{id}", fetchStatusHandler())
+	for i := 0; i < 100 && status.State == "running"; i++ {
+		time.Sleep(50 * time.Millisecond)
+		rec = httptest.NewRecorder()
+		sm.ServeHTTP(rec, httptest.NewRequest("GET", "/fetch/"+status.ID, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, "querying async job should succeed")
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	}
+	assert.Equal(t, "completed", status.State, "async job should complete")
+	for i := 0; i < 100 && v1.State == "running"; i++ {
+		time.Sleep(50 * time.Millisecond)
+		fetchJobs.mutex.Lock()
+		v1 = fetchJobs.jobs[v1.ID].Status()
+		fetchJobs.mutex.Unlock()
+	}
+	assert.Equal(t, int64(len(content)), status.Size)
+	assert.FileExists(t, filename)
+	rec = httptest.NewRecorder()
+	sm.ServeHTTP(rec, httptest.NewRequest("GET", "/fetch/nonexisting", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "unknown jobs should return 404")
+}
+
+// writeTempFile writes the given content into a temporary file and returns its path
+func writeTempFile(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(filename, []byte(content), 0644))
+	return filename
+}
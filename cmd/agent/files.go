@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Maximum size of the text fields of a multipart upload
+const MAX_FIELD_SIZE = 4096
+
+// FileResult is the result of a single file of a multi-file upload
+type FileResult struct {
+	Path     string `json:"path"`            // Destination path
+	Status   string `json:"status"`          // Either ok or error
+	Received int64  `json:"received"`        // Number of received bytes
+	Error    string `json:"error,omitempty"` // Error message, if the file could not be written
+}
+
+// FilesReply is the reply object of a multi-file upload
+type FilesReply struct {
+	Status string       `json:"status"` // Either ok or error, if any file failed
+	Files  []FileResult `json:"files"`  // Per-file results in order of the upload
+}
+
+// parseMode parses an octal file mode, e.g. '0755'
+func parseMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("invalid mode")
+	}
+	return os.FileMode(mode).Perm() | modeBits(mode), nil
+}
+
+// modeBits returns the setuid, setgid and sticky bits of the given unix mode as os.FileMode
+func modeBits(mode uint64) os.FileMode {
+	var bits os.FileMode
+	if mode&04000 != 0 {
+		bits |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		bits |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		bits |= os.ModeSticky
+	}
+	return bits
+}
+
+// writeFilePart writes a single file of a multi-file upload of the given request to the given path.
+// Overwritten files keep their ownership and, unless a mode is given, their permissions. New files are created with 0644
+func writeFilePart(cf Config, r *http.Request, part io.Reader, path string, mode string, checksum string) (int64, error) {
+	if path == "" {
+		return 0, fmt.Errorf("missing 'path' field")
+	}
+	var fileMode os.FileMode = 0644
+	if mode != "" {
+		var err error
+		if fileMode, err = parseMode(mode); err != nil {
+			return 0, err
+		}
+	}
+	filename, err := checkWritePath(r, cf, path)
+	if err != nil {
+		return 0, err
+	}
+	// The size of a single part is unknown, so the whole request needs to fit
+	if err := checkFreeSpace(filename, r.ContentLength); err != nil {
+		return 0, err
+	}
+	existing, err := os.Lstat(filename)
+	if err != nil || !existing.Mode().IsRegular() {
+		existing = nil
+	} else if mode == "" {
+		fileMode = existing.Mode().Perm()
+	}
+	received, err := WriteFileAtomic(filename, part, fileMode, checksum)
+	if err != nil {
+		return received, err
+	}
+	if existing != nil {
+		if err := chownLike(filename, existing); err != nil {
+			log.Printf("error restoring ownership of '%s': %s", path, err)
+		}
+		// Changing the owner clears the setuid and setgid bits
+		if err := os.Chmod(filename, fileMode); err != nil {
+			return received, err
+		}
+	}
+	return received, nil
+}
+
+// putFilesHandler create a new http handler for pushing multiple files to the host via a multipart/form-data request.
+// Each 'file' part is written to the destination given by the preceding 'path' field, with the optional 'mode' and 'checksum' fields.
+func putFilesHandler(cf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+			writeError(w, http.StatusUnsupportedMediaType, "expected multipart/form-data")
+			return
+		}
+		reader := multipart.NewReader(r.Body, params["boundary"])
+
+		reply := FilesReply{Status: "ok", Files: make([]FileResult, 0)}
+		var path, mode, checksum string
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				writeError(w, uploadErrorStatus(err, http.StatusBadRequest), err.Error())
+				return
+			}
+
+			switch part.FormName() {
+			case "path", "mode", "checksum":
+				value, err := io.ReadAll(io.LimitReader(part, MAX_FIELD_SIZE))
+				if err != nil {
+					writeError(w, uploadErrorStatus(err, http.StatusBadRequest), err.Error())
+					return
+				}
+				switch part.FormName() {
+				case "path":
+					path = string(value)
+				case "mode":
+					mode = string(value)
+				case "checksum":
+					checksum = string(value)
+				}
+			case "file":
+				result := FileResult{Path: path, Status: "ok"}
+				result.Received, err = writeFilePart(cf, r, part, path, mode, checksum)
+				if err != nil {
+					result.Status = "error"
+					result.Error = err.Error()
+					reply.Status = "error"
+					// Discard the remains of the failed part to continue with the next one
+					io.Copy(io.Discard, part)
+				}
+				reply.Files = append(reply.Files, result)
+				// Attributes only apply to a single file
+				path, mode, checksum = "", "", ""
+			}
+			part.Close()
+		}
+
+		code := http.StatusOK
+		if reply.Status != "ok" {
+			code = http.StatusMultiStatus
+		}
+		if buf, err := json.Marshal(reply); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		} else {
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(code)
+			w.Write(buf)
+		}
+	})
+}
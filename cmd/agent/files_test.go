@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPutFiles(t *testing.T) {
+	dir := t.TempDir()
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Files.WriteDeny = []string{filepath.Join(dir, "denied")}
+	handler := putFilesHandler(cf)
+	var contentLength int64
+	// Build a multipart form. Each file is a list of field name and value pairs
+	upload := func(files ...[]string) (*httptest.ResponseRecorder, FilesReply) {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		for _, fields := range files {
+			for i := 0; i+1 < len(fields); i += 2 {
+				if fields[i] == "file" {
+					part, err := writer.CreateFormFile("file", "fixture")
+					assert.NoError(t, err)
+					part.Write([]byte(fields[i+1]))
+				} else {
+					assert.NoError(t, writer.WriteField(fields[i], fields[i+1]))
+				}
+			}
+		}
+		assert.NoError(t, writer.Close())
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/files", &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		if contentLength > 0 {
+			req.ContentLength = contentLength
+		}
+		handler.ServeHTTP(rec, req)
+		var reply FilesReply
+		json.Unmarshal(rec.Body.Bytes(), &reply)
+		return rec, reply
+	}
+
+	checksum := "sha256:a948904f2f0f479b8f8197694b30184b0d2ed1c1cd2a1ec0fb85d299a192a447"
+	rec, reply := upload(
+		[]string{"path", filepath.Join(dir, "hello.txt"), "checksum", checksum, "file", "hello world\n"},
+		[]string{"path", filepath.Join(dir, "run.sh"), "mode", "0755", "file", "#!/bin/sh\n"},
+		[]string{"path", filepath.Join(dir, "plain"), "file", "plain"},
+	)
+	assert.Equal(t, http.StatusOK, rec.Code, "multi-file upload should succeed: %s", rec.Body.String())
+	assert.Equal(t, "ok", reply.Status)
+	if assert.Len(t, reply.Files, 3, "reply should contain a result per file") {
+		assert.Equal(t, filepath.Join(dir, "hello.txt"), reply.Files[0].Path)
+		assert.Equal(t, int64(12), reply.Files[0].Received)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "hello.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world\n", string(data))
+	info, err := os.Stat(filepath.Join(dir, "run.sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm(), "mode should be applied")
+	info, err = os.Stat(filepath.Join(dir, "plain"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm(), "mode should default to 0644")
+
+	// Partial failures
+	rec, reply = upload(
+		[]string{"path", filepath.Join(dir, "mismatch"), "checksum", "sha256:0000", "file", "hello world\n"},
+		[]string{"path", filepath.Join(dir, "denied", "file"), "file", "denied"},
+		[]string{"file", "no path"},
+		[]string{"path", filepath.Join(dir, "invalid_mode"), "mode", "999", "file", "invalid mode"},
+		[]string{"path", filepath.Join(dir, "good"), "file", "good"},
+	)
+	assert.Equal(t, http.StatusMultiStatus, rec.Code, "partially failed upload should return multi-status")
+	assert.Equal(t, "error", reply.Status)
+	if assert.Len(t, reply.Files, 5, "reply should contain a result per file") {
+		assert.Contains(t, reply.Files[0].Error, "checksum mismatch")
+		assert.Contains(t, reply.Files[1].Error, "denied")
+		assert.Contains(t, reply.Files[2].Error, "missing 'path'")
+		assert.Contains(t, reply.Files[3].Error, "invalid mode")
+		assert.Equal(t, "ok", reply.Files[4].Status, "files after failed ones should be written")
+	}
+	assert.NoFileExists(t, filepath.Join(dir, "mismatch"), "files with checksum mismatch should not be written")
+	assert.NoFileExists(t, filepath.Join(dir, "invalid_mode"))
+	assert.FileExists(t, filepath.Join(dir, "good"))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	for _, entry := range entries {
+		assert.False(t, strings.HasSuffix(entry.Name(), ".part"), "no temporary files should remain")
+	}
+
+	// Overwritten files keep their permissions, unless a mode is given
+	assert.NoError(t, os.Chmod(filepath.Join(dir, "plain"), 0600))
+	rec, _ = upload(
+		[]string{"path", filepath.Join(dir, "plain"), "file", "overwritten"},
+		[]string{"path", filepath.Join(dir, "run.sh"), "mode", "0700", "file", "#!/bin/sh\n"},
+	)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	info, err = os.Stat(filepath.Join(dir, "plain"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "overwritten files should keep their mode")
+	info, err = os.Stat(filepath.Join(dir, "run.sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm(), "given modes should be applied to overwritten files")
+
+	// Each file needs enough free space for the whole request
+	contentLength = 1 << 62
+	rec, reply = upload([]string{"path", filepath.Join(dir, "huge"), "file", "huge"})
+	contentLength = 0
+	assert.Equal(t, http.StatusMultiStatus, rec.Code)
+	if assert.Len(t, reply.Files, 1) {
+		assert.Contains(t, reply.Files[0].Error, InsufficientStorageError.Error())
+	}
+	assert.NoFileExists(t, filepath.Join(dir, "huge"))
+
+	// Invalid requests
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/files", strings.NewReader("raw body")))
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code, "non-multipart requests should be rejected")
+}
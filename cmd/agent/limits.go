@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// InsufficientStorageError occurs when the target filesystem does not have enough free space
+var InsufficientStorageError = errors.New("insufficient storage")
+
+// checkFreeSpace checks if the filesystem of the given path has at least size bytes available.
+// The path does not need to exist. If the free space cannot be determined, the check passes.
+func checkFreeSpace(path string, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	dir, err := ResolvePath(path)
+	if err != nil {
+		return nil
+	}
+	// Find the nearest existing directory
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		return nil
+	}
+	if uint64(size) > free {
+		return fmt.Errorf("%w: %d bytes required, %d bytes available", InsufficientStorageError, size, free)
+	}
+	return nil
+}
+
+// uploadErrorStatus returns the http status code for the given error that occurred while receiving an upload.
+// Returns fallback for errors that are not related to size limits or free space.
+func uploadErrorStatus(err error, fallback int) int {
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytes), errors.Is(err, SizeLimitError):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, InsufficientStorageError), isDiskFull(err):
+		return http.StatusInsufficientStorage
+	default:
+		return fallback
+	}
+}
+
+// limitBody limits the given request body to the maximum upload size of the configuration, if any
+func limitBody(w http.ResponseWriter, body io.ReadCloser, cf Config) io.ReadCloser {
+	if cf.Webserver.MaxUploadSize <= 0 {
+		return body
+	}
+	return http.MaxBytesReader(w, body, cf.Webserver.MaxUploadSize)
+}
+
+// uploadLimitHandler enforces the maximum upload size and checks if the filesystem of the 'path' argument has
+// enough free space for the announced Content-Length, before passing the request to the next handler.
+func uploadLimitHandler(next http.Handler, cf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		max := cf.Webserver.MaxUploadSize
+		if max > 0 && r.ContentLength > max {
+			writeErrorReply(w, http.StatusRequestEntityTooLarge, ErrorReply{Error: SizeLimitError.Error(), Details: map[string]any{"max": max}})
+			return
+		}
+		if path := r.URL.Query().Get("path"); path != "" {
+			if err := checkFreeSpace(path, r.ContentLength); err != nil {
+				writeError(w, http.StatusInsufficientStorage, err.Error())
+				return
+			}
+		}
+		if r.Body != nil {
+			r.Body = limitBody(w, r.Body, cf)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
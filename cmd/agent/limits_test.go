@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadLimit(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "upload")
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.MaxUploadSize = 100
+	handler := uploadLimitHandler(putFileHandler(cf), cf)
+
+	upload := func(body io.Reader, contentLength int64, encoding string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/file?"+url.Values{"path": {filename}}.Encode(), body)
+		req.ContentLength = contentLength
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusAccepted, upload(strings.NewReader(strings.Repeat("x", 100)), 100, "").Code, "upload within the limit should succeed")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload(strings.NewReader(strings.Repeat("x", 101)), 101, "").Code, "announced uploads beyond the limit should be rejected")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload(strings.NewReader(strings.Repeat("x", 1000)), -1, "").Code, "chunked uploads beyond the limit should be rejected")
+
+	// Compressed uploads must not expand beyond the limit
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(make([]byte, 10000))
+	gz.Close()
+	assert.Less(t, buf.Len(), 100, "compressed test data should be within the limit")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload(&buf, int64(buf.Len()), "gzip").Code, "decompressed uploads beyond the limit should be rejected")
+
+	// Free space preflight
+	cf.Webserver.MaxUploadSize = 0
+	handler = uploadLimitHandler(putFileHandler(cf), cf)
+	assert.Equal(t, http.StatusInsufficientStorage, upload(strings.NewReader("x"), 1<<62, "").Code, "uploads exceeding the free space should be rejected")
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, checkFreeSpace(filepath.Join(dir, "file"), 1024), "small files should fit")
+	assert.NoError(t, checkFreeSpace(filepath.Join(dir, "nonexisting", "dir", "file"), 1024), "non-existing paths should be checked via their parent")
+	assert.ErrorIs(t, checkFreeSpace(filepath.Join(dir, "file"), 1<<62), InsufficientStorageError, "huge files should not fit")
+	assert.Equal(t, http.StatusInsufficientStorage, uploadErrorStatus(checkFreeSpace(dir, 1<<62), 0))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, uploadErrorStatus(SizeLimitError, 0))
+	assert.Equal(t, http.StatusBadRequest, uploadErrorStatus(io.ErrUnexpectedEOF, http.StatusBadRequest))
+}
@@ -10,6 +10,15 @@ import (
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "hash-token" {
+		if err := runHashToken(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "hash-token: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Read configuration
 	config.SetDefaults()
 	config.SetSystemDefaults()
@@ -21,10 +30,28 @@ func main() {
 		fmt.Fprintf(os.Stderr, "invalid program arguments: %s\n", err)
 		os.Exit(1)
 	}
+	config.ApplyPolicy()
+	if err := config.LoadTokens(); err != nil {
+		fmt.Fprintf(os.Stderr, "error loading tokens: %s\n", err)
+		os.Exit(1)
+	}
 	if err := config.SanityCheck(); err != nil {
 		fmt.Fprintf(os.Stderr, "pre-flight check failed: %s\n", err)
 		os.Exit(1)
 	}
+	config.Webserver.Limiter = NewRateLimiter(config.Webserver.RateLimit)
+	if audit, err := OpenAuditLog(config.Audit); err != nil {
+		fmt.Fprintf(os.Stderr, "error opening audit log: %s\n", err)
+		os.Exit(1)
+	} else {
+		config.Audit.Log = audit
+	}
+	if tokens, err := NewTokenStore(config.Webserver.TokenState); err != nil {
+		fmt.Fprintf(os.Stderr, "error loading token state: %s\n", err)
+		os.Exit(1)
+	} else {
+		config.Webserver.Tokens = tokens
+	}
 
 	// Run discovery service
 	if config.Discovery.DiscoveryAddress != "" {
@@ -46,17 +73,25 @@ func main() {
 
 	// Run agent webserver
 	if config.Webserver.BindAddress != "" {
-		http.Handle("GET /health", healthHandler())
-		http.Handle("GET /status", healthHandler())
-		http.Handle("GET /health.json", healthHandler())
-		http.Handle("GET /status.json", healthHandler())
-		http.Handle("POST /exec", checkTokenHandler(execHandler(config), config))
-		http.Handle("GET /file", checkTokenHandler(getFileHandler(), config))
-		http.Handle("POST /file", checkTokenHandler(putFileHandler(), config))
-		log.Printf("openqa-agent listening on %s", config.Webserver.BindAddress)
-		go func() {
-			log.Fatal(http.ListenAndServe(config.Webserver.BindAddress, nil))
-		}()
+		registerRoutes(http.DefaultServeMux, config)
+		server := &http.Server{Addr: config.Webserver.BindAddress, Handler: apiVersionHandler(http.DefaultServeMux)}
+		if config.Webserver.TLS.IsEnabled() {
+			tlsConfig, err := config.Webserver.TLS.TLSConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "tls error: %s\n", err)
+				os.Exit(1)
+			}
+			server.TLSConfig = tlsConfig
+			log.Printf("openqa-agent listening on %s (https)", config.Webserver.BindAddress)
+			go func() {
+				log.Fatal(server.ListenAndServeTLS("", ""))
+			}()
+		} else {
+			log.Printf("openqa-agent listening on %s", config.Webserver.BindAddress)
+			go func() {
+				log.Fatal(server.ListenAndServe())
+			}()
+		}
 	}
 
 	// Run as service. This is currently relevent for Windows only to report back a healthy state
@@ -0,0 +1,20 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// OpenAPI description of the REST API. Must be kept in sync with the routes
+//
+//go:embed openapi.json
+var openapiDocument []byte
+
+// openapiHandler create a new http handler for serving the OpenAPI description of the REST API
+func openapiHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(openapiDocument)
+	})
+}
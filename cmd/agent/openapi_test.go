@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAPI(t *testing.T) {
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]struct {
+					Enum []string `json:"enum"`
+				} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	assert.NoError(t, json.Unmarshal(openapiDocument, &doc), "openapi document must be valid json")
+
+	// Every route must be documented and every documented operation must exist
+	var cf Config
+	cf.SetDefaults()
+	registered := make([]string, 0)
+	for _, route := range routes(cf) {
+		registered = append(registered, route.Method+" "+API_V1_PREFIX+route.Path)
+	}
+	documented := make([]string, 0)
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(registered)
+	sort.Strings(documented)
+	assert.Equal(t, registered, documented, "openapi document must match the registered routes")
+
+	// All error codes must be documented
+	codes := []string{ERR_INVALID_REQUEST, ERR_INVALID_JOB, ERR_UNSUPPORTED_VERSION, ERR_DENIED, ERR_NOT_FOUND, ERR_TIMEOUT, ERR_CANCELED, ERR_EXEC_FAILED, ERR_TOO_LARGE,
+		ERR_INSUFFICIENT_STORAGE, ERR_UNSUPPORTED_MEDIA_TYPE, ERR_RANGE_NOT_SATISFIABLE, ERR_CHECKSUM_MISMATCH, ERR_PATH_TRAVERSAL, ERR_UPSTREAM, ERR_RECEIVE_FAILED, ERR_IO, ERR_RATE_LIMITED, ERR_INTERNAL}
+	assert.ElementsMatch(t, codes, doc.Components.Schemas["ErrorReply"].Properties["code"].Enum, "openapi document must list all error codes")
+
+	// All referenced schemas must exist
+	for _, match := range strings.Split(string(openapiDocument), "\"#/components/schemas/")[1:] {
+		name := match[:strings.Index(match, "\"")]
+		assert.Contains(t, doc.Components.Schemas, name, "referenced schema must exist")
+	}
+
+	// Schemas must match the json objects
+	for name, value := range map[string]any{"ErrorReply": ErrorReply{}, "ExecJob": ExecJob{}, "Reply": Reply{}, "FileResult": FileResult{}, "FilesReply": FilesReply{},
+		"FetchJob": FetchJob{}, "FetchStatus": FetchStatus{}, "WatchEvent": WatchEvent{}, "ManifestEntry": ManifestEntry{}, "Checksum": Checksum{},
+		"Endpoint": Endpoint{}, "Limits": Limits{}, "Capabilities": Capabilities{}, "TokenRequest": TokenRequest{}, "TokenInfo": TokenInfo{}} {
+		fields := make([]string, 0)
+		kind := reflect.TypeOf(value)
+		for i := 0; i < kind.NumField(); i++ {
+			if tag := kind.Field(i).Tag.Get("json"); tag != "" && tag != "-" {
+				fields = append(fields, strings.Split(tag, ",")[0])
+			}
+		}
+		properties := make([]string, 0)
+		for property := range doc.Components.Schemas[name].Properties {
+			properties = append(properties, property)
+		}
+		assert.ElementsMatch(t, fields, properties, "schema %s must match the json fields", name)
+	}
+
+	rec := httptest.NewRecorder()
+	openapiHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/v1/openapi.json", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// PolicyViolationError occurs when a command is rejected by the command policy
+var PolicyViolationError = errors.New("command policy violation")
+
+// SanityCheck checks the policy for invalid patterns and limits
+func (p *Policy) SanityCheck() error {
+	for _, pattern := range append(slices.Clone(p.AllowPatterns), p.DenyPatterns...) {
+		if _, err := compilePattern(pattern); err != nil {
+			return fmt.Errorf("invalid pattern '%s': %w", pattern, err)
+		}
+	}
+	for _, executable := range append(slices.Clone(p.Allow), p.Deny...) {
+		if executable == "" {
+			return fmt.Errorf("empty executable")
+		}
+	}
+	if p.MaxTimeout < 0 {
+		return fmt.Errorf("invalid max_timeout")
+	}
+	for _, name := range p.Env {
+		if name == "" || strings.Contains(name, "=") {
+			return fmt.Errorf("invalid environment variable name '%s'", name)
+		}
+	}
+	return nil
+}
+
+// Active returns true, if the policy restricts any commands
+func (p *Policy) Active() bool {
+	return len(p.Allow) > 0 || len(p.Deny) > 0 || len(p.AllowPatterns) > 0 || len(p.DenyPatterns) > 0 || len(p.Shells) > 0 ||
+		len(p.UIDs) > 0 || len(p.GIDs) > 0 || p.MaxTimeout > 0 || len(p.Env) > 0
+}
+
+// DefaultTimeout returns the given default timeout of jobs, lowered to the maximum timeout if necessary
+func (p *Policy) DefaultTimeout(timeout int64) int64 {
+	if p.MaxTimeout > 0 && timeout > p.MaxTimeout {
+		return p.MaxTimeout
+	}
+	return timeout
+}
+
+// ApplyPolicy clears the system default shell, if the policy allows executables, as those cannot run in a shell.
+// Explicitly configured shells are kept and rejected by SanityCheck
+func (cf *Config) ApplyPolicy() {
+	if len(cf.Policy.Allow) > 0 && DEFAULT_SHELL != "" && cf.DefaultShell == DEFAULT_SHELL {
+		cf.DefaultShell = ""
+	}
+}
+
+// compilePattern compiles the given regular expression, such that it must match the whole command
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// matchPatterns checks if any of the given regular expressions matches the whole command
+func matchPatterns(patterns []string, command string) bool {
+	for _, pattern := range patterns {
+		if re, err := compilePattern(pattern); err == nil && re.MatchString(command) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchExecutable checks if the given executable matches any of the given entries. Entries with a path separator must match exactly,
+// entries without match executables without path or, if anywhere is set, the executable name in any directory
+func matchExecutable(entries []string, executable string, anywhere bool) bool {
+	for _, entry := range entries {
+		if entry == executable {
+			return true
+		}
+		if anywhere && !strings.ContainsAny(entry, "/\\") && filepath.Base(executable) == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckJob checks if the given job complies with the policy. Returns a PolicyViolationError otherwise
+func (p *Policy) CheckJob(job *ExecJob) error {
+	if len(p.UIDs) > 0 && !slices.Contains(p.UIDs, job.UID) {
+		return fmt.Errorf("%w: uid %d not allowed", PolicyViolationError, job.UID)
+	}
+	if len(p.GIDs) > 0 && !slices.Contains(p.GIDs, job.GID) {
+		return fmt.Errorf("%w: gid %d not allowed", PolicyViolationError, job.GID)
+	}
+	if p.MaxTimeout > 0 && job.Timeout > p.MaxTimeout {
+		return fmt.Errorf("%w: timeout exceeds %d seconds", PolicyViolationError, p.MaxTimeout)
+	}
+	// Variables like LD_PRELOAD or BASH_ENV would allow to run arbitrary code with any allowed command
+	if p.Active() {
+		for _, variable := range job.Env {
+			name, _, _ := strings.Cut(variable, "=")
+			if !slices.Contains(p.Env, name) {
+				return fmt.Errorf("%w: environment variable '%s' not allowed", PolicyViolationError, name)
+			}
+		}
+	}
+	if job.Shell != "" && len(p.Shells) > 0 && !slices.Contains(p.Shells, job.Shell) {
+		return fmt.Errorf("%w: shell '%s' not allowed", PolicyViolationError, job.Shell)
+	}
+	executable := ""
+	if split := CommandSplit(job.Command); len(split) > 0 {
+		executable = split[0]
+	}
+	if matchExecutable(p.Deny, executable, true) || matchPatterns(p.DenyPatterns, job.Command) {
+		return fmt.Errorf("%w: command denied", PolicyViolationError)
+	}
+	if len(p.Allow) > 0 || len(p.AllowPatterns) > 0 {
+		allowed := matchPatterns(p.AllowPatterns, job.Command)
+		// A shell would allow to run arbitrary commands with an allowed executable, e.g. 'ls; rm -rf /'
+		if len(p.Allow) > 0 && job.Shell == "" && matchExecutable(p.Allow, executable, false) {
+			allowed = true
+		}
+		if !allowed {
+			return fmt.Errorf("%w: command not allowed", PolicyViolationError)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicySanityCheck(t *testing.T) {
+	var cf Config
+	cf.SetDefaults()
+	cf.Serial.SerialPort = "/dev/ttyS0"
+	assert.NoError(t, cf.SanityCheck(), "the default policy should be valid")
+	cf.Policy.DenyPatterns = []string{"rm (-rf"}
+	assert.Error(t, cf.SanityCheck(), "invalid patterns should be rejected")
+	cf.Policy = Policy{Allow: []string{""}}
+	assert.Error(t, cf.SanityCheck(), "empty executables should be rejected")
+	cf.Policy = Policy{MaxTimeout: -1}
+	assert.Error(t, cf.SanityCheck())
+	cf.Policy = Policy{Env: []string{"LANG="}}
+	assert.Error(t, cf.SanityCheck(), "invalid environment variable names should be rejected")
+	cf.Policy = Policy{Allow: []string{"uname"}}
+	cf.DefaultShell = "bash"
+	assert.Error(t, cf.SanityCheck(), "allowed executables should not be combined with a default shell")
+	cf.ApplyPolicy()
+	assert.Equal(t, "bash", cf.DefaultShell, "explicitly configured shells should be kept")
+	cf.DefaultShell = DEFAULT_SHELL
+	cf.ApplyPolicy()
+	assert.Empty(t, cf.DefaultShell, "the system default shell should be cleared for allowed executables")
+	assert.NoError(t, cf.SanityCheck())
+}
+
+func TestPolicy(t *testing.T) {
+	check := func(policy Policy, job ExecJob) error {
+		if job.Timeout == 0 {
+			job.Timeout = 30
+		}
+		return policy.CheckJob(&job)
+	}
+
+	assert.NoError(t, check(Policy{}, ExecJob{Command: "rm -rf /", Shell: "bash"}), "the empty policy should allow everything")
+
+	// Kiosk-style allowlist of diagnostic commands
+	kiosk := Policy{Allow: []string{"uname", "/usr/bin/df"}, AllowPatterns: []string{`systemctl status [a-z.-]+`}}
+	assert.NoError(t, check(kiosk, ExecJob{Command: "uname -a"}))
+	assert.NoError(t, check(kiosk, ExecJob{Command: "/usr/bin/df -h"}))
+	assert.NoError(t, check(kiosk, ExecJob{Command: "systemctl status sshd.service"}))
+	assert.Error(t, check(kiosk, ExecJob{Command: "systemctl stop sshd.service"}), "patterns should match the whole command")
+	assert.Error(t, check(kiosk, ExecJob{Command: "systemctl status sshd; reboot"}))
+	assert.Error(t, check(kiosk, ExecJob{Command: "/tmp/uname"}), "executables without path should only match commands without path")
+	assert.Error(t, check(kiosk, ExecJob{Command: "df -h"}), "executables with path should match exactly")
+	assert.Error(t, check(kiosk, ExecJob{Command: "uname; reboot", Shell: "bash"}), "allowed executables should not run in a shell")
+	assert.NoError(t, check(kiosk, ExecJob{Command: "systemctl status sshd", Shell: "bash"}), "allowed patterns may run in a shell")
+
+	// Denied executables and patterns take precedence
+	deny := Policy{Deny: []string{"rm", "/sbin/reboot"}, DenyPatterns: []string{`.*\bshutdown\b.*`}, Allow: []string{"rm"}}
+	err := check(deny, ExecJob{Command: "rm -rf /"})
+	assert.True(t, errors.Is(err, PolicyViolationError), "violations should be PolicyViolationErrors")
+	assert.Error(t, check(deny, ExecJob{Command: "/bin/rm -rf /"}), "denied executables should match in any directory")
+	assert.Error(t, check(deny, ExecJob{Command: "/sbin/reboot"}))
+	assert.NoError(t, check(Policy{Deny: []string{"/sbin/reboot"}}, ExecJob{Command: "reboot"}))
+	assert.Error(t, check(deny, ExecJob{Command: "echo 1 && shutdown -h now", Shell: "bash"}))
+
+	// Shells, credentials and timeouts
+	restricted := Policy{Shells: []string{"bash"}, UIDs: []int{1000}, GIDs: []int{100}, MaxTimeout: 60}
+	assert.NoError(t, check(restricted, ExecJob{Command: "id", UID: 1000, GID: 100, Shell: "bash", Timeout: 60}))
+	assert.NoError(t, check(restricted, ExecJob{Command: "id", UID: 1000, GID: 100}), "commands without shell should be allowed")
+	assert.ErrorContains(t, check(restricted, ExecJob{Command: "id", UID: 1000, GID: 100, Shell: "zsh"}), "shell 'zsh' not allowed")
+	assert.ErrorContains(t, check(restricted, ExecJob{Command: "id", UID: 0, GID: 100}), "uid 0 not allowed")
+	assert.ErrorContains(t, check(restricted, ExecJob{Command: "id", UID: 1000, GID: 0}), "gid 0 not allowed")
+	assert.ErrorContains(t, check(restricted, ExecJob{Command: "id", UID: 1000, GID: 100, Timeout: 61}), "timeout exceeds 60 seconds")
+	assert.Equal(t, int64(60), restricted.DefaultTimeout(300), "default timeouts should be lowered to the maximum timeout")
+	assert.Equal(t, int64(30), restricted.DefaultTimeout(30))
+	assert.Equal(t, int64(300), (&Policy{}).DefaultTimeout(300), "without maximum timeout the default should be kept")
+
+	// Environment variables
+	assert.NoError(t, check(Policy{}, ExecJob{Command: "id", Env: []string{"LD_PRELOAD=/tmp/evil.so"}}), "the empty policy should allow any environment")
+	env := Policy{Allow: []string{"id"}, Env: []string{"LANG"}}
+	assert.NoError(t, check(env, ExecJob{Command: "id", Env: []string{"LANG=C"}}))
+	assert.ErrorContains(t, check(env, ExecJob{Command: "id", Env: []string{"LANG=C", "LD_PRELOAD=/tmp/evil.so"}}), "environment variable 'LD_PRELOAD' not allowed")
+	assert.Error(t, check(Policy{MaxTimeout: 60}, ExecJob{Command: "id", Env: []string{"BASH_ENV=/tmp/evil"}}), "active policies should reject unlisted environment variables")
+}
+
+func TestPolicyEnforcement(t *testing.T) {
+	var audit bytes.Buffer
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Token = []Token{{Token: "secret"}}
+	cf.Policy = Policy{Allow: []string{"true"}, UIDs: []int{0}, MaxTimeout: 10}
+	cf.Audit.Log = NewAuditLog(&audit)
+	mux := http.NewServeMux()
+	registerRoutes(mux, cf)
+
+	exec := func(job string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/exec", strings.NewReader(job))
+		req.Header.Set("Token", "secret")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(t, http.StatusOK, exec(`{"cmd":"true"}`).Code)
+	rec := exec(`{"cmd":"false"}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "policy violations should be rejected")
+	var reply ErrorReply
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reply))
+	assert.Equal(t, ERR_DENIED, reply.Code)
+	assert.Equal(t, "command policy violation: command not allowed", reply.Error)
+	assert.Equal(t, http.StatusForbidden, exec(`{"cmd":"true","uid":1000}`).Code)
+
+	records := readAuditRecords(t, &audit)
+	if assert.Len(t, records, 3) {
+		assert.Empty(t, records[0].Error)
+		assert.Equal(t, "false", records[1].Command)
+		assert.Equal(t, "command policy violation: command not allowed", records[1].Error, "violations should be audited")
+		assert.Nil(t, records[1].ReturnCode, "rejected commands should not have a return code")
+	}
+
+	assert.Equal(t, http.StatusForbidden, exec(`{"cmd":"true","timeout":20}`).Code, "timeouts above the maximum should be rejected")
+	assert.Equal(t, http.StatusForbidden, exec(`{"cmd":"true","env":["LD_PRELOAD=/tmp/evil.so"]}`).Code, "environment variables should be rejected")
+
+	// The policy applies to the serial terminal as well
+	audit.Reset()
+	terminal := NewTerminalEmulator()
+	terminal.in.Write([]byte("true\nfalse\n"))
+	runSerialTerminalAgent(&terminal, cf)
+	decoder := json.NewDecoder(terminal.out)
+	var serial Reply
+	assert.NoError(t, decoder.Decode(&serial))
+	assert.Equal(t, 0, serial.ReturnCode)
+	assert.NoError(t, decoder.Decode(&serial))
+	assert.Equal(t, -1, serial.ReturnCode)
+	assert.Equal(t, "command policy violation: command not allowed", serial.StdErr)
+	records = readAuditRecords(t, &audit)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "command policy violation: command not allowed", records[1].Error)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Delay of replies to failed authentications, to slow down guessing of tokens
+const AUTH_FAILURE_DELAY = 500 * time.Millisecond
+
+// Idle time after which the rate limit state of a source address is discarded
+const RATE_LIMIT_RETENTION = 10 * time.Minute
+
+// SanityCheck checks the limit for invalid values
+func (l *Limit) SanityCheck() error {
+	if l.Rate < 0 || l.Burst < 0 {
+		return fmt.Errorf("invalid rate limit")
+	}
+	return nil
+}
+
+// burst returns the effective burst of the limit
+func (l *Limit) burst() float64 {
+	return math.Max(1, math.Max(float64(l.Burst), l.Rate))
+}
+
+// SanityCheck checks the rate limits for invalid values
+func (rl *RateLimit) SanityCheck() error {
+	if err := rl.PerSource.SanityCheck(); err != nil {
+		return err
+	}
+	for path, limit := range rl.Endpoints {
+		if err := limit.SanityCheck(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if rl.MaxFailures < 0 || rl.FailureWindow < 0 || rl.Lockout < 0 {
+		return fmt.Errorf("invalid authentication failure limits")
+	}
+	if rl.MaxFailures > 0 && (rl.FailureWindow == 0 || rl.Lockout == 0) {
+		return fmt.Errorf("failure_window and lockout are required with max_failures")
+	}
+	return nil
+}
+
+// bucket is a token bucket for rate limiting
+type bucket struct {
+	tokens float64   // Available tokens
+	last   time.Time // Time of the last update
+}
+
+// take takes a token from the bucket. Returns the time until the next token is available, if the bucket is empty
+func (b *bucket) take(limit Limit, now time.Time) time.Duration {
+	burst := limit.burst()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// failures are the failed authentications of a source address
+type failures struct {
+	count  int       // Failed authentications in the current window
+	first  time.Time // Time of the first failed authentication in the current window
+	locked time.Time // End of the lockout
+}
+
+// RateLimiter holds the state of the per-source rate limits and failed authentications
+type RateLimiter struct {
+	mutex    sync.Mutex
+	limits   RateLimit
+	sources  map[string]*bucket
+	failures map[string]*failures
+	pruned   time.Time
+}
+
+// NewRateLimiter creates a rate limiter with the given limits
+func NewRateLimiter(limits RateLimit) *RateLimiter {
+	return &RateLimiter{limits: limits, sources: make(map[string]*bucket), failures: make(map[string]*failures)}
+}
+
+// prune discards the state of idle sources. The mutex must be held by the caller
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for source, b := range l.sources {
+		if now.Sub(b.last) > RATE_LIMIT_RETENTION {
+			delete(l.sources, source)
+		}
+	}
+	window := time.Duration(l.limits.FailureWindow) * time.Second
+	for source, f := range l.failures {
+		if now.After(f.locked) && now.Sub(f.first) > window {
+			delete(l.failures, source)
+		}
+	}
+}
+
+// Allow checks the per-source rate limit for a request of the given source. Returns the time to wait, if the request exceeds the limit
+func (l *RateLimiter) Allow(source string) time.Duration {
+	if l.limits.PerSource.Rate <= 0 {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.prune(now)
+	b, ok := l.sources[source]
+	if !ok {
+		b = &bucket{}
+		l.sources[source] = b
+	}
+	return b.take(l.limits.PerSource, now)
+}
+
+// Locked returns the remaining lockout time of the given source, if it is locked out
+func (l *RateLimiter) Locked(source string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if f, ok := l.failures[source]; ok {
+		if remaining := time.Until(f.locked); remaining > 0 {
+			return remaining
+		}
+	}
+	return 0
+}
+
+// Failure records a failed authentication of the given source. Returns the lockout time, if the source is locked out now
+func (l *RateLimiter) Failure(source string) time.Duration {
+	if l.limits.MaxFailures <= 0 {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.prune(now)
+	f, ok := l.failures[source]
+	if !ok || now.Sub(f.first) > time.Duration(l.limits.FailureWindow)*time.Second {
+		f = &failures{first: now}
+		l.failures[source] = f
+	}
+	f.count++
+	if f.count < l.limits.MaxFailures {
+		return 0
+	}
+	lockout := time.Duration(l.limits.Lockout) * time.Second
+	f.locked = now.Add(lockout)
+	f.count = 0
+	f.first = now
+	return lockout
+}
+
+// Success resets the failed authentications of the given source
+func (l *RateLimiter) Success(source string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.failures, source)
+}
+
+// requestSource returns the source address of the given request. Forwarding headers are ignored, as they can be forged
+func requestSource(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeRateLimited rejects a request with 429 and a Retry-After header
+func writeRateLimited(w http.ResponseWriter, retry time.Duration, message string) {
+	seconds := int64(math.Ceil(retry.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(max(seconds, 1), 10))
+	writeErrorReply(w, http.StatusTooManyRequests, ErrorReply{Error: message, Details: map[string]any{"retry_after": max(seconds, 1)}})
+}
+
+// sourceLimitHandler enforces the per-source rate limit of the given rate limiter
+func sourceLimitHandler(next http.Handler, limiter *RateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if retry := limiter.Allow(requestSource(r)); retry > 0 {
+			writeRateLimited(w, retry, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// endpointLimitHandler enforces a global rate limit on the requests to an endpoint
+func endpointLimitHandler(next http.Handler, limit Limit) http.Handler {
+	var mutex sync.Mutex
+	var b bucket
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		retry := b.take(limit, time.Now())
+		mutex.Unlock()
+		if retry > 0 {
+			writeRateLimited(w, retry, "endpoint rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authFailure records a failed authentication of the given request, logs it and delays the reply. Returns the lockout time, if the
+// source is locked out now
+func authFailure(r *http.Request, limiter *RateLimiter) time.Duration {
+	source := requestSource(r)
+	log.Printf("authentication failed: %s %s from %s", r.Method, r.URL.Path, source)
+	lockout := limiter.Failure(source)
+	if lockout > 0 {
+		log.Printf("locking out %s for %s after repeated authentication failures", source, lockout)
+	}
+	time.Sleep(AUTH_FAILURE_DELAY)
+	return lockout
+}
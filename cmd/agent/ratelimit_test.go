@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket(t *testing.T) {
+	limit := Limit{Rate: 2, Burst: 3}
+	now := time.Now()
+	var b bucket
+	for i := 0; i < 3; i++ {
+		assert.Zero(t, b.take(limit, now), "requests within the burst should pass")
+	}
+	retry := b.take(limit, now)
+	assert.Equal(t, 500*time.Millisecond, retry, "a token should be available again after 1/rate seconds")
+	assert.Zero(t, b.take(limit, now.Add(500*time.Millisecond)), "tokens should be refilled over time")
+	assert.NotZero(t, b.take(limit, now.Add(500*time.Millisecond)))
+	// Refilling is capped at the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.Zero(t, b.take(limit, now))
+	}
+	assert.NotZero(t, b.take(limit, now))
+
+	// The burst defaults to the rate, but is at least 1
+	assert.Equal(t, 5.0, (&Limit{Rate: 5}).burst())
+	assert.Equal(t, 1.0, (&Limit{Rate: 0.1}).burst())
+}
+
+func TestRateLimitSanityCheck(t *testing.T) {
+	var cf Config
+	cf.SetDefaults()
+	assert.NoError(t, cf.Webserver.RateLimit.SanityCheck(), "defaults should be valid")
+	assert.Error(t, (&RateLimit{PerSource: Limit{Rate: -1}}).SanityCheck())
+	assert.Error(t, (&RateLimit{Endpoints: map[string]Limit{"/exec": {Burst: -1}}}).SanityCheck())
+	assert.Error(t, (&RateLimit{MaxFailures: 3}).SanityCheck(), "max_failures requires a window and a lockout")
+	assert.NoError(t, (&RateLimit{}).SanityCheck(), "disabled limits should be valid")
+}
+
+func TestLockout(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{MaxFailures: 3, FailureWindow: 60, Lockout: 300})
+	assert.Zero(t, limiter.Failure("10.0.0.1"))
+	assert.Zero(t, limiter.Failure("10.0.0.1"))
+	assert.Zero(t, limiter.Locked("10.0.0.1"))
+	assert.Equal(t, 300*time.Second, limiter.Failure("10.0.0.1"), "the third failure should lock out the source")
+	assert.NotZero(t, limiter.Locked("10.0.0.1"))
+	assert.Zero(t, limiter.Locked("10.0.0.2"), "other sources should not be locked out")
+
+	// Successful authentications reset the failures
+	assert.Zero(t, limiter.Failure("10.0.0.2"))
+	assert.Zero(t, limiter.Failure("10.0.0.2"))
+	limiter.Success("10.0.0.2")
+	assert.Zero(t, limiter.Failure("10.0.0.2"))
+	assert.Zero(t, limiter.Failure("10.0.0.2"))
+
+	// Without max_failures, sources are never locked out
+	limiter = NewRateLimiter(RateLimit{})
+	for i := 0; i < 20; i++ {
+		assert.Zero(t, limiter.Failure("10.0.0.1"))
+	}
+	assert.Zero(t, limiter.Locked("10.0.0.1"))
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Token = []Token{{Token: "secret"}}
+	cf.Webserver.RateLimit.MaxFailures = 2
+	cf.Webserver.RateLimit.Endpoints = map[string]Limit{"/capabilities": {Rate: 0.001, Burst: 2}}
+	cf.Webserver.Limiter = NewRateLimiter(cf.Webserver.RateLimit)
+	mux := http.NewServeMux()
+	registerRoutes(mux, cf)
+
+	request := func(source string, path string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = source + ":40000"
+		if token != "" {
+			req.Header.Set("Token", token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	checkRateLimited := func(rec *httptest.ResponseRecorder) {
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		retry, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+		assert.NoError(t, err, "throttled requests should have a Retry-After header")
+		assert.Positive(t, retry)
+		var reply ErrorReply
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reply))
+		assert.Equal(t, ERR_RATE_LIMITED, reply.Code)
+		assert.EqualValues(t, retry, reply.Details["retry_after"])
+	}
+
+	// Endpoint limits apply globally and only to authenticated requests
+	assert.Equal(t, http.StatusUnauthorized, request("10.0.0.3", "/v1/capabilities", "").Code)
+	assert.Equal(t, http.StatusOK, request("10.0.0.3", "/v1/capabilities", "secret").Code)
+	assert.Equal(t, http.StatusOK, request("10.0.0.4", "/v1/capabilities", "secret").Code)
+	checkRateLimited(request("10.0.0.3", "/v1/capabilities", "secret"))
+	assert.Equal(t, http.StatusOK, request("10.0.0.3", "/v1/health", "").Code, "other endpoints should not be limited")
+
+	// Repeated failed authentications lock out the source, also for valid tokens
+	assert.Equal(t, http.StatusUnauthorized, request("10.0.0.1", "/v1/file", "wrong").Code)
+	checkRateLimited(request("10.0.0.1", "/v1/file", "wrong"))
+	checkRateLimited(request("10.0.0.1", "/v1/file", "secret"))
+	assert.Equal(t, http.StatusOK, request("10.0.0.1", "/v1/health", "").Code, "unauthenticated endpoints should not be locked")
+	assert.Equal(t, http.StatusUnauthorized, request("10.0.0.2", "/v1/file", "wrong").Code, "other sources should not be locked out")
+}
+
+func TestSourceLimit(t *testing.T) {
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.RateLimit.PerSource = Limit{Rate: 0.001, Burst: 2}
+	cf.Webserver.Limiter = NewRateLimiter(cf.Webserver.RateLimit)
+	mux := http.NewServeMux()
+	registerRoutes(mux, cf)
+
+	request := func(source string) int {
+		req := httptest.NewRequest("GET", "/v1/health", nil)
+		req.RemoteAddr = source + ":40000"
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, request("10.0.0.1"))
+	assert.Equal(t, http.StatusOK, request("10.0.0.1"))
+	assert.Equal(t, http.StatusTooManyRequests, request("10.0.0.1"), "requests above the burst should be throttled")
+	assert.Equal(t, http.StatusOK, request("10.0.0.2"), "sources should be limited independently")
+	assert.Equal(t, http.StatusOK, request("[::1]"))
+}
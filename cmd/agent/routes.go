@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Prefix of all version 1 endpoints
+const API_V1_PREFIX = "/v1"
+
+// Route is a single endpoint of the REST API
+type Route struct {
+	Method      string       // http method
+	Path        string       // Path below the version prefix, e.g. '/exec' for '/v1/exec'
+	Legacy      []string     // Unversioned paths of the route, kept for existing clients
+	Auth        bool         // Requires a valid authentication token
+	Scope       string       // Scope required by authenticated routes, if any
+	QueryToken  bool         // Streaming route, that accepts the token as query parameter if enabled in the configuration
+	Description string       // Short description of the endpoint
+	Handler     http.Handler // Handler without authentication
+}
+
+// Endpoint describes a route in the capabilities reply
+type Endpoint struct {
+	Method      string   `json:"method"`           // http method
+	Path        string   `json:"path"`             // Versioned path
+	Legacy      []string `json:"legacy,omitempty"` // Unversioned paths
+	Auth        bool     `json:"auth"`             // Requires authentication
+	Scope       string   `json:"scope,omitempty"`  // Required scope of the token or client certificate
+	Description string   `json:"description"`      // Short description
+}
+
+// Limits are the limits of the agent in the capabilities reply
+type Limits struct {
+	MaxUpload    int64 `json:"max_upload"`     // Maximum upload size in bytes or 0 if unlimited
+	MaxOutput    int   `json:"max_output"`     // Maximum captured stdout and stderr of a command in bytes
+	MaxFieldSize int   `json:"max_field_size"` // Maximum size of text fields of multipart uploads in bytes
+}
+
+// Capabilities is the reply object of the capabilities endpoint
+type Capabilities struct {
+	APIVersions []int      `json:"api_versions"` // Supported API versions
+	Endpoints   []Endpoint `json:"endpoints"`    // All available endpoints
+	Features    []string   `json:"features"`     // Optional features supported by the agent
+	Encodings   []string   `json:"encodings"`    // Supported Content-Encoding and Accept-Encoding values
+	Checksums   []string   `json:"checksums"`    // Supported checksum algorithms
+	Limits      Limits     `json:"limits"`       // Limits of the agent
+}
+
+// Optional features, that clients can check for in the capabilities
+var features = []string{"compression", "range", "resume", "atomic_upload", "multi_upload", "tail", "watch", "fetch", "checksum", "archive", "path_restrictions", "upload_limit", "scopes", "runtime_tokens", "signatures", "rate_limits", "audit", "command_policy"}
+
+// routes returns all routes of the REST API for the given configuration
+func routes(cf Config) []Route {
+	routes := []Route{
+		{Method: "GET", Path: "/health", Legacy: []string{"/health", "/status", "/health.json", "/status.json"}, Description: "Get agent health", Handler: healthHandler()},
+		{Method: "POST", Path: "/exec", Legacy: []string{"/exec"}, Auth: true, Scope: SCOPE_EXEC, Description: "Run a command", Handler: compressHandler(execHandler(cf))},
+		{Method: "GET", Path: "/file", Legacy: []string{"/file"}, Auth: true, Scope: SCOPE_FILE_READ, Description: "Get a file", Handler: compressHandler(getFileHandler(cf))},
+		{Method: "POST", Path: "/file", Legacy: []string{"/file"}, Auth: true, Scope: SCOPE_FILE_WRITE, Description: "Push a file", Handler: uploadLimitHandler(putFileHandler(cf), cf)},
+		{Method: "POST", Path: "/files", Legacy: []string{"/files"}, Auth: true, Scope: SCOPE_FILE_WRITE, Description: "Push multiple files via multipart/form-data", Handler: uploadLimitHandler(putFilesHandler(cf), cf)},
+		{Method: "GET", Path: "/file/tail", Legacy: []string{"/file/tail"}, Auth: true, Scope: SCOPE_FILE_READ, QueryToken: true, Description: "Get the last lines of a file and optionally follow it", Handler: tailFileHandler(cf)},
+		{Method: "POST", Path: "/fetch", Legacy: []string{"/fetch"}, Auth: true, Scope: SCOPE_FILE_WRITE, Description: "Download a URL onto the host", Handler: fetchHandler(cf)},
+		{Method: "GET", Path: "/fetch/{id}", Legacy: []string{"/fetch/{id}"}, Auth: true, Scope: SCOPE_FILE_WRITE, Description: "Get the progress of an asynchronous download", Handler: fetchStatusHandler()},
+		{Method: "DELETE", Path: "/fetch/{id}", Legacy: []string{"/fetch/{id}"}, Auth: true, Scope: SCOPE_FILE_WRITE, Description: "Cancel an asynchronous download", Handler: fetchStatusHandler()},
+		{Method: "GET", Path: "/watch", Legacy: []string{"/watch"}, Auth: true, Scope: SCOPE_FILE_READ, QueryToken: true, Description: "Watch a file or directory for changes", Handler: watchHandler(cf)},
+		{Method: "GET", Path: "/checksum", Legacy: []string{"/checksum"}, Auth: true, Scope: SCOPE_FILE_READ, Description: "Get the checksum of a file or directory", Handler: compressHandler(checksumHandler(cf))},
+		{Method: "GET", Path: "/archive", Legacy: []string{"/archive"}, Auth: true, Scope: SCOPE_FILE_READ, Description: "Get a directory as tar archive", Handler: compressHandler(getArchiveHandler(cf))},
+		{Method: "POST", Path: "/archive", Legacy: []string{"/archive"}, Auth: true, Scope: SCOPE_FILE_WRITE, Description: "Push a tar archive and extract it", Handler: uploadLimitHandler(putArchiveHandler(cf), cf)},
+		{Method: "GET", Path: "/tokens", Auth: true, Scope: SCOPE_ADMIN, Description: "List the tokens created at runtime", Handler: listTokensHandler(cf)},
+		{Method: "POST", Path: "/tokens", Auth: true, Scope: SCOPE_ADMIN, Description: "Create a short-lived token", Handler: createTokenHandler(cf)},
+		{Method: "DELETE", Path: "/tokens/{id}", Auth: true, Scope: SCOPE_ADMIN, Description: "Revoke a token created at runtime", Handler: revokeTokenHandler(cf)},
+		{Method: "GET", Path: "/openapi.json", Description: "Get the OpenAPI description of the API", Handler: compressHandler(openapiHandler())},
+		{Method: "GET", Path: "/capabilities", Auth: true, Description: "Get the supported endpoints, features and limits"},
+	}
+	// The capabilities list all routes, including themselves
+	routes[len(routes)-1].Handler = capabilitiesHandler(cf, routes)
+	return routes
+}
+
+// registerRoutes registers all routes of the REST API below the version prefix and at their legacy paths
+func registerRoutes(mux *http.ServeMux, cf Config) {
+	for _, route := range routes(cf) {
+		handler := route.Handler
+		if limit, ok := cf.Webserver.RateLimit.Endpoints[route.Path]; ok && limit.Rate > 0 {
+			handler = endpointLimitHandler(handler, limit)
+		}
+		if route.Auth {
+			handler = checkTokenHandler(scopeHandler(handler, route.Scope), cf)
+			if route.QueryToken && cf.Webserver.QueryToken {
+				handler = queryTokenHandler(handler)
+			}
+		}
+		if cf.Webserver.Limiter != nil {
+			handler = sourceLimitHandler(handler, cf.Webserver.Limiter)
+		}
+		if cf.Audit.Log != nil {
+			handler = auditHandler(handler, cf.Audit.Log)
+		}
+		mux.Handle(route.Method+" "+API_V1_PREFIX+route.Path, apiV1Handler(handler))
+		for _, path := range route.Legacy {
+			mux.Handle(route.Method+" "+path, handler)
+		}
+	}
+}
+
+// apiV1Handler serves requests to the versioned paths with version 1 of the API, regardless of the 'Api-Version' header
+func apiV1Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Api-Version", "1")
+		next.ServeHTTP(w, withAPIVersion(r, API_V1))
+	})
+}
+
+// capabilitiesHandler create a new http handler for listing the supported endpoints, features and limits of the agent
+func capabilitiesHandler(cf Config, routes []Route) http.Handler {
+	capabilities := Capabilities{
+		APIVersions: []int{API_LEGACY, API_V1},
+		Endpoints:   make([]Endpoint, 0, len(routes)),
+		Features:    features,
+		Encodings:   supportedEncodings,
+		Checksums:   checksumAlgorithms,
+		Limits:      Limits{MaxUpload: cf.Webserver.MaxUploadSize, MaxOutput: MAX_BUFFER, MaxFieldSize: MAX_FIELD_SIZE},
+	}
+	for _, route := range routes {
+		capabilities.Endpoints = append(capabilities.Endpoints, Endpoint{Method: route.Method, Path: API_V1_PREFIX + route.Path, Legacy: route.Legacy, Auth: route.Auth, Scope: route.Scope, Description: route.Description})
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if buf, err := json.Marshal(capabilities); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+		} else {
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(buf)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutes(t *testing.T) {
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Token = []Token{{Token: "secret"}}
+	cf.Webserver.MaxUploadSize = 1024
+	mux := http.NewServeMux()
+	registerRoutes(mux, cf)
+	handler := apiVersionHandler(mux)
+
+	request := func(method string, path string, body string, token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Token", token)
+		}
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Versioned and legacy paths
+	assert.Equal(t, http.StatusOK, request("GET", "/v1/health", "", "").Code, "health should not require authentication")
+	assert.Equal(t, http.StatusOK, request("GET", "/health.json", "", "").Code, "legacy health paths should be kept")
+	rec := request("POST", "/v1/exec", `{"cmd":"true"}`, "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "versioned paths should require authentication")
+	assert.Equal(t, "Bearer realm=\"openqa-agent\"", rec.Header().Get("WWW-Authenticate"), "unauthorized replies should carry a challenge")
+	assert.Equal(t, http.StatusForbidden, request("POST", "/exec", `{"cmd":"true"}`, "").Code, "legacy clients should get 403 for failed authentications")
+	rec = request("POST", "/v1/exec", `{"cmd":"true"}`, "secret")
+	assert.Equal(t, http.StatusOK, rec.Code, "versioned paths should use version 1")
+	assert.Equal(t, "1", rec.Header().Get("Api-Version"))
+	assert.Equal(t, http.StatusAccepted, request("POST", "/exec", `{"cmd":"true"}`, "secret").Code, "legacy paths should use the legacy version")
+	assert.Equal(t, http.StatusNotFound, request("GET", "/capabilities", "", "secret").Code, "new endpoints should only be versioned")
+
+	// Capabilities
+	rec = request("GET", "/v1/capabilities", "", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var capabilities Capabilities
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &capabilities))
+	assert.Contains(t, capabilities.APIVersions, API_V1)
+	assert.Equal(t, int64(1024), capabilities.Limits.MaxUpload)
+	assert.Contains(t, capabilities.Features, "archive")
+	assert.Contains(t, capabilities.Encodings, "zstd")
+	assert.Len(t, capabilities.Endpoints, len(routes(cf)), "capabilities should list all routes")
+	assert.Contains(t, capabilities.Endpoints, Endpoint{Method: "GET", Path: "/v1/capabilities", Auth: true, Description: "Get the supported endpoints, features and limits"})
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	sr "go.bug.st/serial"
 )
@@ -20,6 +21,7 @@ type Reply struct {
 	ReturnCode int    `json:"ret"`     // Return code
 	StdOut     string `json:"stdout"`  // Standard output
 	StdErr     string `json:"stderr"`  // Standard error
+	Timeout    bool   `json:"timeout"` // True if the command has been abandoned after running into its timeout
 }
 
 // Parse the given serial port argument into port and mode
@@ -155,7 +157,7 @@ func runSerialTerminalAgent(stream io.ReadWriter, conf Config) error {
 		job.SetDefaults()
 		job.Shell = conf.DefaultShell
 		job.WorkDir = conf.DefaultWorkDir
-		job.Timeout = 60
+		job.Timeout = conf.Policy.DefaultTimeout(60)
 
 		// Try to parse the lines as json. Tread it as raw command, if it fails.
 		if err := json.Unmarshal([]byte(command), &job); err != nil {
@@ -166,15 +168,24 @@ func runSerialTerminalAgent(stream io.ReadWriter, conf Config) error {
 			job.Command = command
 		}
 
+		rec := &AuditRecord{Time: time.Now(), Transport: "serial", Source: conf.Serial.SerialPort, Endpoint: "exec"}
+		rec.SetJob(&job)
+
 		var reply Reply
 		reply.Command = job.Command
 		reply.Shell = job.Shell
-		if err := job.SanityCheck(); err != nil {
+		err = job.SanityCheck()
+		if err == nil {
+			err = conf.Policy.CheckJob(&job)
+		}
+		if err != nil {
+			rec.SetError(err)
 			reply.Runtime = 0
 			reply.ReturnCode = -1
 			reply.StdErr = err.Error()
 		} else {
-			err := job.exec()
+			err = job.exec()
+			rec.SetError(err)
 
 			reply.Runtime = job.runtime
 			reply.ReturnCode = job.ret
@@ -183,6 +194,7 @@ func runSerialTerminalAgent(stream io.ReadWriter, conf Config) error {
 			if err != nil {
 				if errors.Is(err, TimeoutError) {
 					reply.ReturnCode = 124
+					reply.Timeout = true
 				} else {
 					log.Printf("execution of '%s' failed: %s", command, err)
 					reply.ReturnCode = -1
@@ -191,18 +203,23 @@ func runSerialTerminalAgent(stream io.ReadWriter, conf Config) error {
 		}
 
 		log.Printf("serial command: '%s' -> %d", command, reply.ReturnCode)
-		if buf, err := json.Marshal(reply); err != nil {
+		buf, err := json.Marshal(reply)
+		if err != nil {
 			return err
-		} else {
-			if _, err := stream.Write(buf); err != nil {
+		}
+		rec.SetReturnCode(reply.ReturnCode)
+		rec.BytesIn = int64(len(line))
+		rec.BytesOut = int64(len(buf))
+		rec.Duration = time.Since(rec.Time).Milliseconds()
+		conf.Audit.Log.Write(rec)
+		if _, err := stream.Write(buf); err != nil {
+			return err
+		}
+		// Add termination character to mark the end of the json object
+		if conf.Serial.Serialized {
+			if _, err := stream.Write([]byte{'\n'}); err != nil {
 				return err
 			}
-			// Add termination character to mark the end of the json object
-			if conf.Serial.Serialized {
-				if _, err := stream.Write([]byte{'\n'}); err != nil {
-					return err
-				}
-			}
 		}
 	}
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Authorization scheme of signed requests
+const SIGNATURE_SCHEME = "HMAC-SHA256"
+
+// Header with the hex-encoded SHA-256 sum of the request body, covered by the signature
+const SIGNATURE_BODY_HEADER = "X-Content-Sha256"
+
+// Default maximum clock skew between client and agent for signed requests
+const DEFAULT_SIGNATURE_SKEW = 5 * time.Minute
+
+// Signed request bodies up to this size are verified in memory. Larger bodies are verified in a temporary file
+const SIGNATURE_BUFFER = 1024 * 1024
+
+// Maximum length of nonces
+const MAX_NONCE_LENGTH = 128
+
+// SHA-256 sum of the empty body
+var emptyBodySum = sha256.Sum256(nil)
+
+// BodySignatureError occurs when the request body does not match the signed body hash
+var BodySignatureError = errors.New("request body does not match its signature")
+
+// Signature are the parameters of the Authorization header of a signed request, e.g.
+// 'Authorization: HMAC-SHA256 key=worker1, timestamp=1700000000, nonce=8f2c61d0, signature=<hex>'
+type Signature struct {
+	Key       string // Identifier of the signing key
+	Timestamp int64  // Unix time of the request
+	Nonce     string // Unique value per request
+	Signature []byte // HMAC-SHA256 of the canonical request
+}
+
+// nonceCache remembers the nonces of signed requests within the clock skew window to reject replayed requests
+type nonceCache struct {
+	mutex  sync.Mutex
+	nonces map[string]time.Time // Nonces and when they can be forgotten
+	pruned time.Time            // Time of the last pruning
+}
+
+var signatureNonces = nonceCache{nonces: make(map[string]time.Time)}
+
+// Use records the given nonce until the given time. Returns false, if the nonce has been used already
+func (c *nonceCache) Use(nonce string, until time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(c.pruned) > time.Minute {
+		for n, expires := range c.nonces {
+			if now.After(expires) {
+				delete(c.nonces, n)
+			}
+		}
+		c.pruned = now
+	}
+	if expires, ok := c.nonces[nonce]; ok && !now.After(expires) {
+		return false
+	}
+	c.nonces[nonce] = until
+	return true
+}
+
+// parseSignature parses the Authorization header of a signed request. Returns false, if the header is not a signature
+func parseSignature(authorization string) (Signature, bool, error) {
+	var sig Signature
+	scheme, params, found := strings.Cut(strings.TrimSpace(authorization), " ")
+	if !found || !strings.EqualFold(scheme, SIGNATURE_SCHEME) {
+		return sig, false, nil
+	}
+	for _, param := range strings.Split(params, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found {
+			return sig, true, fmt.Errorf("invalid signature parameter")
+		}
+		value = strings.Trim(value, "\"")
+		switch name {
+		case "key":
+			sig.Key = value
+		case "timestamp":
+			timestamp, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return sig, true, fmt.Errorf("invalid timestamp")
+			}
+			sig.Timestamp = timestamp
+		case "nonce":
+			sig.Nonce = value
+		case "signature":
+			buf, err := hex.DecodeString(value)
+			if err != nil {
+				return sig, true, fmt.Errorf("invalid signature")
+			}
+			sig.Signature = buf
+		}
+	}
+	if sig.Key == "" || sig.Timestamp == 0 || sig.Nonce == "" || len(sig.Signature) == 0 {
+		return sig, true, fmt.Errorf("incomplete signature")
+	}
+	if len(sig.Nonce) > MAX_NONCE_LENGTH {
+		return sig, true, fmt.Errorf("nonce too long")
+	}
+	return sig, true, nil
+}
+
+// CanonicalRequest returns the string that is signed for the given request: method, path with query, timestamp, nonce and
+// hex-encoded SHA-256 sum of the body, separated by newlines
+func CanonicalRequest(method string, uri string, timestamp int64, nonce string, bodySum string) string {
+	return strings.Join([]string{method, uri, strconv.FormatInt(timestamp, 10), nonce, bodySum}, "\n")
+}
+
+// SignRequest computes the HMAC-SHA256 signature of the given canonical request with the given key
+func SignRequest(key string, canonical string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(canonical))
+	return mac.Sum(nil)
+}
+
+// spooledBody is a verified request body in a temporary file. Closing it removes the file
+type spooledBody struct {
+	*os.File
+}
+
+func (b *spooledBody) Close() error {
+	b.File.Close()
+	return os.Remove(b.Name())
+}
+
+// CheckSignature checks if the given request carries a valid HMAC signature of a configured signing key within the allowed clock skew
+// and with an unused nonce. Returns the identity of the signing key. The request body is verified against the signed body hash
+// before the request is processed.
+func (cf *Config) CheckSignature(r *http.Request) (Identity, bool) {
+	var sig Signature
+	found := false
+	for _, authorization := range r.Header["Authorization"] {
+		var err error
+		if sig, found, err = parseSignature(authorization); err != nil {
+			return Identity{}, false
+		} else if found {
+			break
+		}
+	}
+	if !found {
+		return Identity{}, false
+	}
+
+	skew := DEFAULT_SIGNATURE_SKEW
+	if cf.Webserver.SignatureSkew > 0 {
+		skew = time.Duration(cf.Webserver.SignatureSkew) * time.Second
+	}
+	timestamp := time.Unix(sig.Timestamp, 0)
+	if delta := time.Since(timestamp); delta > skew || delta < -skew {
+		return Identity{}, false
+	}
+
+	bodySum := hex.EncodeToString(emptyBodySum[:])
+	if header := r.Header.Get(SIGNATURE_BODY_HEADER); header != "" {
+		bodySum = strings.ToLower(header)
+	}
+	expected, err := hex.DecodeString(bodySum)
+	if err != nil || len(expected) != sha256.Size {
+		return Identity{}, false
+	}
+
+	for _, key := range cf.Webserver.SigningKeys {
+		if key.ID != sig.Key || key.Key == "" {
+			continue
+		}
+		canonical := CanonicalRequest(r.Method, r.URL.RequestURI(), sig.Timestamp, sig.Nonce, bodySum)
+		if !hmac.Equal(SignRequest(key.Key, canonical), sig.Signature) {
+			return Identity{}, false
+		}
+		// Only valid signatures use up their nonce. Nonces are remembered as long as their timestamp is accepted
+		if !signatureNonces.Use(key.ID+":"+sig.Nonce, timestamp.Add(skew)) {
+			return Identity{}, false
+		}
+		if err := verifyBody(r, expected, cf.Webserver.MaxUploadSize); err != nil {
+			return Identity{}, false
+		}
+		name := key.Name
+		if name == "" {
+			name = key.ID
+		}
+		return Identity{Name: name, Method: AUTH_SIGNATURE, Permissions: key.Permissions}, true
+	}
+	return Identity{}, false
+}
+
+// verifyBody verifies the body of the given request against the given SHA-256 sum before replacing it by the verified copy.
+// Bodies up to SIGNATURE_BUFFER bytes are kept in memory, larger ones are spooled to a temporary file, which is removed when the
+// body is closed. Spooled bodies are limited to the given size, unless it is 0
+func verifyBody(r *http.Request, expected []byte, limit int64) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		if !bytes.Equal(expected, emptyBodySum[:]) {
+			return BodySignatureError
+		}
+		return nil
+	}
+	hash := sha256.New()
+	if r.ContentLength >= 0 && r.ContentLength <= SIGNATURE_BUFFER {
+		buf, err := io.ReadAll(io.LimitReader(io.TeeReader(r.Body, hash), SIGNATURE_BUFFER+1))
+		if err != nil {
+			return err
+		}
+		if !hmac.Equal(hash.Sum(nil), expected) {
+			return BodySignatureError
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(buf))
+		return nil
+	}
+
+	// Handlers must not see unverified data of large bodies, as they might write it before reaching the end of the body
+	file, err := os.CreateTemp("", "openqa-agent-body-*")
+	if err != nil {
+		return err
+	}
+	body := &spooledBody{File: file}
+	var reader io.Reader = r.Body
+	if limit > 0 {
+		reader = io.LimitReader(r.Body, limit+1)
+	}
+	size, err := io.Copy(io.MultiWriter(file, hash), reader)
+	if err == nil && limit > 0 && size > limit {
+		err = fmt.Errorf("body exceeds %d bytes", limit)
+	}
+	if err == nil && !hmac.Equal(hash.Sum(nil), expected) {
+		err = BodySignatureError
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		body.Close()
+		return err
+	}
+	r.Body.Close()
+	r.Body = body
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signedRequest creates a request signed with the given key at the given time
+func signedRequest(method string, uri string, body string, keyID string, key string, timestamp int64, nonce string) *http.Request {
+	req := httptest.NewRequest(method, uri, strings.NewReader(body))
+	sum := sha256.Sum256([]byte(body))
+	bodySum := hex.EncodeToString(sum[:])
+	req.Header.Set(SIGNATURE_BODY_HEADER, bodySum)
+	signature := SignRequest(key, CanonicalRequest(method, req.URL.RequestURI(), timestamp, nonce, bodySum))
+	req.Header.Set("Authorization", fmt.Sprintf("%s key=%s, timestamp=%d, nonce=%s, signature=%s", SIGNATURE_SCHEME, keyID, timestamp, nonce, hex.EncodeToString(signature)))
+	return req
+}
+
+func TestSignature(t *testing.T) {
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.SigningKeys = []SigningKey{{ID: "worker1", Key: "s3cr3t", Permissions: Permissions{Scopes: []string{SCOPE_EXEC}}}}
+	var body string
+	var identity Identity
+	handler := checkTokenHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = requestIdentity(r)
+		buf, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = string(buf)
+	}), cf)
+	request := func(req *http.Request) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	now := time.Now().Unix()
+
+	assert.Equal(t, http.StatusOK, request(signedRequest("POST", "/v1/exec", `{"cmd":"true"}`, "worker1", "s3cr3t", now, "n1")), "signed requests should be accepted")
+	assert.Equal(t, `{"cmd":"true"}`, body, "the body should be passed on")
+	assert.Equal(t, Identity{Name: "worker1", Method: AUTH_SIGNATURE, Permissions: Permissions{Scopes: []string{SCOPE_EXEC}}}, identity)
+	assert.Equal(t, http.StatusForbidden, request(signedRequest("POST", "/v1/exec", `{"cmd":"true"}`, "worker1", "s3cr3t", now, "n1")), "replayed nonces should be rejected")
+	assert.Equal(t, http.StatusOK, request(signedRequest("GET", "/v1/health", "", "worker1", "s3cr3t", now, "n2")), "signed requests without body should be accepted")
+
+	assert.Equal(t, http.StatusForbidden, request(signedRequest("POST", "/v1/exec", "", "worker1", "wrong", now, "n3")), "wrong keys should be rejected")
+	assert.Equal(t, http.StatusForbidden, request(signedRequest("POST", "/v1/exec", "", "worker2", "s3cr3t", now, "n4")), "unknown keys should be rejected")
+	assert.Equal(t, http.StatusForbidden, request(signedRequest("POST", "/v1/exec", "", "worker1", "s3cr3t", now-600, "n5")), "old timestamps should be rejected")
+	assert.Equal(t, http.StatusForbidden, request(signedRequest("POST", "/v1/exec", "", "worker1", "s3cr3t", now+600, "n6")), "future timestamps should be rejected")
+	assert.Equal(t, http.StatusOK, request(signedRequest("POST", "/v1/exec", "", "worker1", "s3cr3t", now-60, "n7")), "timestamps within the clock skew should be accepted")
+
+	// Tampering with the request
+	req := signedRequest("POST", "/v1/exec", `{"cmd":"true"}`, "worker1", "s3cr3t", now, "n8")
+	req.URL.Path = "/v1/file"
+	assert.Equal(t, http.StatusForbidden, request(req), "modified paths should be rejected")
+	req = signedRequest("POST", "/v1/exec", `{"cmd":"true"}`, "worker1", "s3cr3t", now, "n9")
+	req.Body = io.NopCloser(strings.NewReader(`{"cmd":"rm -rf /"}`))
+	assert.Equal(t, http.StatusForbidden, request(req), "modified bodies should be rejected")
+	req = signedRequest("POST", "/v1/exec", `{"cmd":"true"}`, "worker1", "s3cr3t", now, "n10")
+	req.Header.Del(SIGNATURE_BODY_HEADER)
+	assert.Equal(t, http.StatusForbidden, request(req), "bodies without signed hash should be rejected")
+	req = signedRequest("POST", "/v1/exec", "", "worker1", "s3cr3t", now, "n11")
+	req.Header.Set("Authorization", SIGNATURE_SCHEME+" key=worker1, nonce=n11")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "incomplete signatures should be rejected")
+	assert.Contains(t, rec.Header().Values("WWW-Authenticate"), `HMAC-SHA256 realm="openqa-agent"`)
+
+	// Large bodies are verified before the request is processed
+	spool := t.TempDir()
+	t.Setenv("TMPDIR", spool)
+	large := strings.Repeat("x", 2*SIGNATURE_BUFFER)
+	req = signedRequest("POST", "/v1/file", large, "worker1", "s3cr3t", now, "n12")
+	assert.Equal(t, http.StatusOK, request(req))
+	assert.Equal(t, len(large), len(body))
+	body = ""
+	req = signedRequest("POST", "/v1/file", large, "worker1", "s3cr3t", now, "n13")
+	req.Body = io.NopCloser(strings.NewReader(large[1:] + "y"))
+	assert.Equal(t, http.StatusForbidden, request(req), "modified large bodies should be rejected")
+	assert.Empty(t, body, "modified large bodies must not reach the handler")
+	req = signedRequest("POST", "/v1/file", large, "worker1", "s3cr3t", now, "n14")
+	req.ContentLength = -1
+	req.Body = io.NopCloser(strings.NewReader("y" + large[1:]))
+	assert.Equal(t, http.StatusForbidden, request(req), "modified bodies of unknown length should be rejected")
+	assert.Empty(t, body)
+	cf.Webserver.MaxUploadSize = SIGNATURE_BUFFER
+	limited := checkTokenHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), cf)
+	rec = httptest.NewRecorder()
+	limited.ServeHTTP(rec, signedRequest("POST", "/v1/file", large, "worker1", "s3cr3t", now, "n15"))
+	assert.Equal(t, http.StatusForbidden, rec.Code, "spooled bodies should not exceed the upload limit")
+	entries, err := os.ReadDir(spool)
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "spooled bodies should be removed")
+}
+
+func TestNonceCache(t *testing.T) {
+	cache := nonceCache{nonces: make(map[string]time.Time)}
+	assert.True(t, cache.Use("a", time.Now().Add(1*time.Minute)))
+	assert.False(t, cache.Use("a", time.Now().Add(1*time.Minute)), "nonces must not be reused")
+	assert.True(t, cache.Use("b", time.Now().Add(-1*time.Second)))
+	assert.True(t, cache.Use("b", time.Now().Add(1*time.Minute)), "expired nonces can be forgotten")
+}
+
+func TestSigningKeys(t *testing.T) {
+	t.Setenv("OPENQA_AGENT_TEST_KEY", "fr0men5")
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.BindAddress = "127.0.0.1:8421"
+	cf.Webserver.SigningKeys = []SigningKey{{ID: "worker1", Env: "OPENQA_AGENT_TEST_KEY"}}
+	assert.NoError(t, cf.SanityCheck(), "signing keys should be sufficient for the webserver")
+	assert.NoError(t, cf.LoadTokens())
+	assert.Equal(t, "fr0men5", cf.Webserver.SigningKeys[0].Key, "keys should be loaded from the environment")
+
+	cf.Webserver.SigningKeys = []SigningKey{{ID: "worker1", Key: "a"}, {ID: "worker1", Key: "b"}}
+	assert.Error(t, cf.SanityCheck(), "duplicate key ids should be rejected")
+	cf.Webserver.SigningKeys = []SigningKey{{Key: "a"}}
+	assert.Error(t, cf.SanityCheck(), "keys without id should be rejected")
+	cf.Webserver.SigningKeys = []SigningKey{{ID: "worker1"}}
+	assert.Error(t, cf.SanityCheck(), "empty keys should be rejected")
+	cf.Webserver.SigningKeys = []SigningKey{{ID: "worker1", Key: "a"}}
+	cf.Webserver.SignatureSkew = -1
+	assert.Error(t, cf.SanityCheck(), "negative clock skews should be rejected")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval in which followed files are checked for new data
+var tailPollInterval = 250 * time.Millisecond
+
+// Default number of lines returned by the tail endpoint
+const DEFAULT_TAIL_LINES = 10
+
+// tailOffset returns the offset in the given file, at which the last n lines begin
+func tailOffset(file *os.File, size int64, n int) (int64, error) {
+	if n <= 0 {
+		return size, nil
+	}
+	const blockSize = 4096
+	buf := make([]byte, blockSize)
+	offset := size
+	lines := 0
+	for offset > 0 {
+		length := int64(blockSize)
+		if offset < length {
+			length = offset
+		}
+		offset -= length
+		if _, err := file.ReadAt(buf[:length], offset); err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		for i := length - 1; i >= 0; i-- {
+			if buf[i] != '\n' {
+				continue
+			}
+			// A trailing newline terminates the last line and does not start a new one
+			if offset+i == size-1 {
+				continue
+			}
+			lines++
+			if lines >= n {
+				return offset + i + 1, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// tailWriter writes followed file contents either as plain text or as server-sent events
+type tailWriter struct {
+	w       http.ResponseWriter
+	sse     bool   // Write server-sent events instead of plain text
+	pending []byte // Incomplete line, which is not yet sent as event
+}
+
+func (tw *tailWriter) Write(buf []byte) (int, error) {
+	if !tw.sse {
+		return tw.w.Write(buf)
+	}
+	tw.pending = append(tw.pending, buf...)
+	for {
+		i := bytes.IndexByte(tw.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSuffix(string(tw.pending[:i]), "\r")
+		tw.pending = tw.pending[i+1:]
+		if _, err := fmt.Fprintf(tw.w, "data: %s\n\n", line); err != nil {
+			return 0, err
+		}
+	}
+	return len(buf), nil
+}
+
+// Event notifies the client about a rotated or truncated file. Plain text clients don't receive events
+func (tw *tailWriter) Event(event string) error {
+	if !tw.sse {
+		return nil
+	}
+	_, err := fmt.Fprintf(tw.w, "event: %s\ndata: \n\n", event)
+	return err
+}
+
+// Flush sends all pending data to the client
+func (tw *tailWriter) Flush() error {
+	return http.NewResponseController(tw.w).Flush()
+}
+
+// tailFileHandler create a new http handler for getting the last lines of a file and optionally following appended data
+func tailFileHandler(cf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := r.URL.Query()
+		paths := values["path"]
+		if len(paths) <= 0 || paths[0] == "" {
+			writeError(w, http.StatusBadRequest, "missing 'path' argument")
+			return
+		}
+		lines := DEFAULT_TAIL_LINES
+		if value := values.Get("lines"); value != "" {
+			var err error
+			if lines, err = strconv.Atoi(value); err != nil || lines < 0 {
+				writeError(w, http.StatusBadRequest, "invalid lines")
+				return
+			}
+		}
+		follow := false
+		if value := values.Get("follow"); value != "" {
+			var err error
+			if follow, err = strconv.ParseBool(value); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid follow")
+				return
+			}
+		}
+		// Optional timeout in seconds after which following the file stops
+		var timeout <-chan time.Time
+		if value := values.Get("timeout"); value != "" {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid timeout")
+				return
+			}
+			timeout = time.After(time.Duration(seconds) * time.Second)
+		}
+
+		filename, err := checkReadPath(r, cf, paths[0])
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+		file, err := os.Open(filename)
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+		defer func() { file.Close() }()
+		info, err := file.Stat()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if info.IsDir() {
+			writeError(w, http.StatusBadRequest, "path is a directory")
+			return
+		}
+		offset, err := tailOffset(file, info.Size(), lines)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		writer := &tailWriter{w: w, sse: strings.Contains(r.Header.Get("Accept"), "text/event-stream")}
+		if writer.sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		w.WriteHeader(http.StatusOK)
+
+		// Send the last lines. Errors here mean that the client has disconnected
+		n, err := io.Copy(writer, file)
+		if err != nil || !follow {
+			return
+		}
+		offset += n
+		if err := writer.Flush(); err != nil {
+			return
+		}
+
+		// Follow appended data until the client disconnects or the timeout is reached
+		ticker := time.NewTicker(tailPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-timeout:
+				return
+			case <-ticker.C:
+			}
+
+			// Read all appended data
+			n, err := io.Copy(writer, file)
+			if err != nil {
+				return
+			}
+			offset += n
+
+			if current, err := os.Stat(filename); err == nil {
+				if !os.SameFile(info, current) {
+					// File has been rotated. Drain the remains of the old file and continue with the new one
+					n, err := io.Copy(writer, file)
+					if err != nil {
+						return
+					}
+					offset += n
+					rotated, err := os.Open(filename)
+					if err != nil {
+						// Rotation might be still in progress
+						continue
+					}
+					file.Close()
+					file = rotated
+					info = current
+					offset = 0
+					if err := writer.Event("rotated"); err != nil {
+						return
+					}
+				} else if current.Size() < offset {
+					// File has been truncated. Continue from the beginning
+					if _, err := file.Seek(0, io.SeekStart); err != nil {
+						return
+					}
+					offset = 0
+					if err := writer.Event("truncated"); err != nil {
+						return
+					}
+				}
+			}
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}
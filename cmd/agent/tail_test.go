@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTail(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "messages")
+	assert.NoError(t, os.WriteFile(filename, []byte("line 1\nline 2\nline 3\nline 4\nline 5\n"), 0644))
+	var cf Config
+	cf.SetDefaults()
+	handler := tailFileHandler(cf)
+
+	request := func(values url.Values) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		values.Set("path", filename)
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/file/tail?"+values.Encode(), nil))
+		return rec
+	}
+
+	rec := request(url.Values{"lines": {"2"}})
+	assert.Equal(t, http.StatusOK, rec.Code, "tail request should succeed")
+	assert.Equal(t, "line 4\nline 5\n", rec.Body.String(), "tail should return the last two lines")
+	rec = request(url.Values{"lines": {"100"}})
+	assert.Equal(t, "line 1\nline 2\nline 3\nline 4\nline 5\n", rec.Body.String(), "tail should return the whole file if it is shorter")
+	rec = request(url.Values{"lines": {"0"}})
+	assert.Equal(t, "", rec.Body.String(), "tail of zero lines should be empty")
+	rec = request(url.Values{})
+	assert.Equal(t, http.StatusOK, rec.Code, "tail with default lines should succeed")
+
+	// Files without trailing newline
+	assert.NoError(t, os.WriteFile(filename, []byte("line 1\nline 2\nline 3"), 0644))
+	rec = request(url.Values{"lines": {"2"}})
+	assert.Equal(t, "line 2\nline 3", rec.Body.String(), "tail should handle missing trailing newlines")
+
+	// Error handling
+	assert.Equal(t, http.StatusBadRequest, request(url.Values{"lines": {"-1"}}).Code, "negative lines should be rejected")
+	assert.Equal(t, http.StatusBadRequest, request(url.Values{"follow": {"maybe"}}).Code, "invalid follow should be rejected")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/file/tail?"+url.Values{"path": {filename + ".1"}}.Encode(), nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "non-existing files should return 404")
+}
+
+func TestTailFollow(t *testing.T) {
+	tailPollInterval = 10 * time.Millisecond
+	filename := filepath.Join(t.TempDir(), "messages")
+	assert.NoError(t, os.WriteFile(filename, []byte("line 1\nline 2\n"), 0644))
+	var cf Config
+	cf.SetDefaults()
+	server := httptest.NewServer(tailFileHandler(cf))
+	defer server.Close()
+
+	appendFile := func(data string) {
+		file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		assert.NoError(t, err)
+		file.WriteString(data)
+		file.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/file/tail?"+url.Values{"path": {filename}, "lines": {"1"}, "follow": {"true"}}.Encode(), nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err, "follow request should succeed") {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	reader := bufio.NewReader(res.Body)
+
+	// Read the next server-sent event
+	next := func() (string, string) {
+		event := "message"
+		data := ""
+		for {
+			line, err := reader.ReadString('\n')
+			if !assert.NoError(t, err, "reading event should succeed") {
+				return "", ""
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				return event, data
+			}
+			if value, ok := strings.CutPrefix(line, "event: "); ok {
+				event = value
+			} else if value, ok := strings.CutPrefix(line, "data: "); ok {
+				data = value
+			}
+		}
+	}
+
+	_, data := next()
+	assert.Equal(t, "line 2", data, "last line should be sent first")
+
+	// Appended lines
+	appendFile("line 3\n")
+	_, data = next()
+	assert.Equal(t, "line 3", data, "appended line should be followed")
+
+	// Truncation
+	assert.NoError(t, os.Truncate(filename, 0))
+	event, _ := next()
+	assert.Equal(t, "truncated", event, "truncation should be detected")
+	appendFile("line 4\n")
+	_, data = next()
+	assert.Equal(t, "line 4", data, "lines after truncation should be followed")
+
+	// Rotation
+	assert.NoError(t, os.Rename(filename, filename+".1"))
+	appendFile("line 5\n")
+	event, _ = next()
+	assert.Equal(t, "rotated", event, "rotation should be detected")
+	_, data = next()
+	assert.Equal(t, "line 5", data, "lines after rotation should be followed")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Validity of generated self-signed certificates
+const SELF_SIGNED_VALIDITY = 10 * 365 * 24 * time.Hour
+
+// parseTLSVersion parses a TLS version, e.g. '1.2'. An empty version is the default minimum version 1.2
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2", "":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid tls version: %s", version)
+	}
+}
+
+// IsEnabled returns true if the webserver should serve HTTPS
+func (t *TLS) IsEnabled() bool {
+	return t.Enabled || t.Cert != "" || t.ClientCA != ""
+}
+
+// normalizeFingerprint brings a fingerprint in the form 'sha256:hex' with optional colons between the hex bytes into the form of CertificateFingerprint
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToLower(strings.TrimSpace(fingerprint))
+	algo, sum, found := strings.Cut(fingerprint, ":")
+	if !found {
+		return fingerprint
+	}
+	return algo + ":" + strings.ReplaceAll(sum, ":", "")
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the given DER-encoded certificate in the form 'sha256:hex'
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// generateCertificate generates a self-signed certificate for the local host and writes it and its private key as PEM files
+func generateCertificate(certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "openqa-agent", Organization: []string{"openqa-agent"}},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(SELF_SIGNED_VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+	}
+	// Write the key first, so that a certificate never exists without its key
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// loadCertificate loads the given certificate and key. If generate is true and neither of them exists, a self-signed certificate is generated first
+func loadCertificate(certFile string, keyFile string, generate bool) (tls.Certificate, error) {
+	if generate {
+		_, certErr := os.Stat(certFile)
+		_, keyErr := os.Stat(keyFile)
+		if errors.Is(certErr, fs.ErrNotExist) && errors.Is(keyErr, fs.ErrNotExist) {
+			log.Printf("generating self-signed certificate %s", certFile)
+			if err := generateCertificate(certFile, keyFile); err != nil {
+				return tls.Certificate{}, fmt.Errorf("generating self-signed certificate failed: %w", err)
+			}
+		}
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// TLSConfig loads the configured certificate and returns the TLS configuration of the webserver. With a client CA, clients must present a verified certificate.
+// Without a configured certificate, a self-signed certificate is generated once and persisted at the system default location.
+// The fingerprint of the certificate is logged, so that clients can pin it.
+func (t *TLS) TLSConfig() (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(t.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	certFile, keyFile, generate := t.Cert, t.Key, false
+	if certFile == "" {
+		certFile, keyFile, generate = DEFAULT_TLS_CERT, DEFAULT_TLS_KEY, true
+	}
+	cert, err := loadCertificate(certFile, keyFile, generate)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("tls certificate %s fingerprint: %s", certFile, CertificateFingerprint(cert.Certificate[0]))
+	tlsConfig := &tls.Config{MinVersion: minVersion, Certificates: []tls.Certificate{cert}}
+	if t.ClientCA != "" {
+		bundle, err := os.ReadFile(t.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %s", t.ClientCA)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
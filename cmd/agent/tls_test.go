@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	for value, expected := range map[string]uint16{"": tls.VersionTLS12, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13, "1.0": tls.VersionTLS10} {
+		version, err := parseTLSVersion(value)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, version, "version of '%s'", value)
+	}
+	_, err := parseTLSVersion("3")
+	assert.Error(t, err, "invalid versions should be rejected")
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls", "agent.crt")
+	keyFile := filepath.Join(dir, "tls", "agent.key")
+
+	_, err := loadCertificate(certFile, keyFile, false)
+	assert.Error(t, err, "missing certificates must not be generated unless requested")
+	cert, err := loadCertificate(certFile, keyFile, true)
+	assert.NoError(t, err, "generating self-signed certificate should succeed")
+	info, err := os.Stat(keyFile)
+	assert.NoError(t, err)
+	if info != nil {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "private key must only be readable by the owner")
+	}
+	// The certificate is persisted and reused
+	reloaded, err := loadCertificate(certFile, keyFile, true)
+	assert.NoError(t, err)
+	assert.Equal(t, CertificateFingerprint(cert.Certificate[0]), CertificateFingerprint(reloaded.Certificate[0]), "persisted certificate should be reused")
+
+	// Serve https with the configured certificate
+	tlsCfg := TLS{Cert: certFile, Key: keyFile, MinVersion: "1.3"}
+	assert.True(t, tlsCfg.IsEnabled(), "configured certificate should enable tls")
+	serverConfig, err := tlsCfg.TLSConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), serverConfig.MinVersion)
+	server := httptest.NewUnstartedServer(healthHandler())
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	res, err := client.Get(server.URL + "/health")
+	if assert.NoError(t, err, "https request with pinned certificate should succeed") {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12}}}
+	_, err = client.Get(server.URL + "/health")
+	assert.Error(t, err, "connections below the minimum tls version should fail")
+}
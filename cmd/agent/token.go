@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Default algorithm for hashing tokens
+const DEFAULT_TOKEN_HASH = "argon2id"
+
+// Parameters for argon2id token hashes, following the OWASP recommendation. Tokens are random, unlike passwords, so the memory
+// cost is kept low to limit the load of failed authentications on the host
+const (
+	ARGON2_TIME    = 2
+	ARGON2_MEMORY  = 19 * 1024
+	ARGON2_THREADS = 1
+	ARGON2_KEYLEN  = 32
+)
+
+// Maximum number of concurrent verifications of slow token hashes (argon2id and bcrypt). Further verifications wait, so that a
+// burst of unauthenticated requests cannot exhaust the memory of the host
+const MAX_HASH_VERIFICATIONS = 2
+
+var hashVerifications = make(chan struct{}, MAX_HASH_VERIFICATIONS)
+
+// Salt length in bytes of argon2id and sha256 token hashes
+const TOKEN_SALT_LENGTH = 16
+
+// Supported token hash algorithms
+var tokenHashAlgorithms = []string{"argon2id", "bcrypt", "sha256"}
+
+var b64 = base64.RawStdEncoding
+
+// HashToken computes a salted hash of the given token with the given algorithm (argon2id, bcrypt or sha256).
+// The result is in PHC string format, e.g. '$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>'
+func HashToken(token string, algo string) (string, error) {
+	if token == "" {
+		return "", fmt.Errorf("empty token")
+	}
+	salt := make([]byte, TOKEN_SALT_LENGTH)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	switch algo {
+	case "argon2id":
+		key := argon2.IDKey([]byte(token), salt, ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS, ARGON2_KEYLEN)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, ARGON2_MEMORY, ARGON2_TIME, ARGON2_THREADS, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	case "bcrypt":
+		hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.DefaultCost)
+		return string(hash), err
+	case "sha256":
+		sum := sha256.Sum256(append(salt, []byte(token)...))
+		return fmt.Sprintf("$sha256$%s$%s", b64.EncodeToString(salt), b64.EncodeToString(sum[:])), nil
+	default:
+		return "", fmt.Errorf("unsupported hash algorithm: %s", algo)
+	}
+}
+
+// ParseTokenHash checks the format of the given token hash and returns its algorithm
+func ParseTokenHash(hash string) (string, error) {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		if _, _, _, err := parseArgon2Hash(hash); err != nil {
+			return "", err
+		}
+		return "argon2id", nil
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return "", fmt.Errorf("invalid bcrypt hash: %w", err)
+		}
+		return "bcrypt", nil
+	case strings.HasPrefix(hash, "$sha256$"):
+		if _, _, err := parseSha256Hash(hash); err != nil {
+			return "", err
+		}
+		return "sha256", nil
+	default:
+		return "", fmt.Errorf("unsupported token hash")
+	}
+}
+
+// argon2Params are the parameters of an argon2id hash
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// parseArgon2Hash parses an argon2id hash in PHC string format. Returns the parameters, salt and key
+func parseArgon2Hash(hash string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	var version int
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil || params.time == 0 || params.threads == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters")
+	}
+	salt, err := b64.DecodeString(fields[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id salt")
+	}
+	key, err := b64.DecodeString(fields[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+	return params, salt, key, nil
+}
+
+// parseSha256Hash parses a salted sha256 hash in the form '$sha256$<salt>$<hash>'. Returns salt and hash
+func parseSha256Hash(hash string) ([]byte, []byte, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 4 {
+		return nil, nil, fmt.Errorf("invalid sha256 hash")
+	}
+	salt, err := b64.DecodeString(fields[2])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid sha256 salt")
+	}
+	sum, err := b64.DecodeString(fields[3])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, nil, fmt.Errorf("invalid sha256 hash")
+	}
+	return salt, sum, nil
+}
+
+// Cache of successfully verified token hashes. Verifying argon2id and bcrypt hashes is deliberately slow and must not happen on every request.
+// Keys are the sha256 sums of hash and token, so that no plaintext tokens are kept in memory.
+var verifiedTokens sync.Map
+
+// VerifyTokenHash checks in constant time if the given token matches the given hash
+func VerifyTokenHash(token string, hash string) bool {
+	if token == "" || hash == "" {
+		return false
+	}
+	cacheKey := sha256.Sum256([]byte(hash + "\x00" + token))
+	if _, ok := verifiedTokens.Load(cacheKey); ok {
+		return true
+	}
+	valid := false
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := parseArgon2Hash(hash)
+		if err == nil {
+			hashVerifications <- struct{}{}
+			computed := argon2.IDKey([]byte(token), salt, params.time, params.memory, params.threads, uint32(len(key)))
+			<-hashVerifications
+			valid = subtle.ConstantTimeCompare(computed, key) == 1
+		}
+	case strings.HasPrefix(hash, "$2"):
+		hashVerifications <- struct{}{}
+		valid = bcrypt.CompareHashAndPassword([]byte(hash), []byte(token)) == nil
+		<-hashVerifications
+	case strings.HasPrefix(hash, "$sha256$"):
+		salt, sum, err := parseSha256Hash(hash)
+		if err == nil {
+			computed := sha256.Sum256(append(salt, []byte(token)...))
+			valid = subtle.ConstantTimeCompare(computed[:], sum) == 1
+		}
+	}
+	if valid {
+		verifiedTokens.Store(cacheKey, true)
+	}
+	return valid
+}
+
+// compareTokens compares two plaintext tokens in constant time, independent of their lengths
+func compareTokens(a string, b string) bool {
+	sumA := sha256.Sum256([]byte(a))
+	sumB := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(sumA[:], sumB[:]) == 1
+}
+
+// runHashToken runs the hash-token subcommand, which prints the hash of a token for the 'hash' field of the configuration.
+// The token is read from the first line of stdin, if not given as argument, so that it does not show up in the process list.
+func runHashToken(args []string) error {
+	flags := flag.NewFlagSet("hash-token", flag.ContinueOnError)
+	algo := flags.String("a", DEFAULT_TOKEN_HASH, "hash algorithm ("+strings.Join(tokenHashAlgorithms, ", ")+")")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: openqa-agent hash-token [-a ALGORITHM] [TOKEN]\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var token string
+	switch flags.NArg() {
+	case 0:
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		token = strings.TrimSpace(line)
+	case 1:
+		token = flags.Arg(0)
+	default:
+		return fmt.Errorf("too many arguments")
+	}
+	hash, err := HashToken(token, *algo)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+)
+
+func TestHashToken(t *testing.T) {
+	for _, algo := range tokenHashAlgorithms {
+		hash, err := HashToken("s3cr3t", algo)
+		assert.NoError(t, err, "hashing with %s should succeed", algo)
+		parsed, err := ParseTokenHash(hash)
+		assert.NoError(t, err, "%s hash should be valid", algo)
+		assert.Equal(t, algo, parsed, "hash algorithm should be detected")
+		assert.True(t, VerifyTokenHash("s3cr3t", hash), "%s hash should match its token", algo)
+		assert.True(t, VerifyTokenHash("s3cr3t", hash), "cached %s hash should match its token", algo)
+		assert.False(t, VerifyTokenHash("s3cr3t2", hash), "%s hash should not match other tokens", algo)
+		assert.False(t, VerifyTokenHash("", hash), "%s hash should not match the empty token", algo)
+
+		other, err := HashToken("s3cr3t", algo)
+		assert.NoError(t, err)
+		assert.NotEqual(t, hash, other, "%s hashes should be salted", algo)
+	}
+	_, err := HashToken("s3cr3t", "md5")
+	assert.Error(t, err, "unsupported algorithms should be rejected")
+	_, err = HashToken("", DEFAULT_TOKEN_HASH)
+	assert.Error(t, err, "empty tokens should be rejected")
+
+	// Hashes with other parameters, e.g. created by earlier versions, remain valid
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("s3cr3t"), salt, 3, 64*1024, 4, 32)
+	legacy := fmt.Sprintf("$argon2id$v=19$m=65536,t=3,p=4$%s$%s", b64.EncodeToString(salt), b64.EncodeToString(key))
+	assert.True(t, VerifyTokenHash("s3cr3t", legacy), "argon2id hashes with other parameters should be valid")
+
+	for _, hash := range []string{"", "s3cr3t", "$argon2id$v=19$m=65536$salt$hash", "$2b$10$invalid", "$sha256$c2FsdA$aGFzaA", "$md5$salt$hash"} {
+		_, err := ParseTokenHash(hash)
+		assert.Error(t, err, "invalid hash '%s' should be rejected", hash)
+		assert.False(t, VerifyTokenHash(hash, hash), "invalid hash '%s' should never match", hash)
+	}
+}
+
+func TestConcurrentHashVerifications(t *testing.T) {
+	hash, err := HashToken("s3cr3t", "argon2id")
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 4*MAX_HASH_VERIFICATIONS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.False(t, VerifyTokenHash(fmt.Sprintf("wrong%d", i), hash))
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, hashVerifications, 0, "all verifications should be released")
+}
+
+func TestHashedTokens(t *testing.T) {
+	hash, err := HashToken("hashed", "sha256")
+	assert.NoError(t, err)
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Token = []Token{{Token: "plain"}, {Hash: hash}}
+	assert.True(t, cf.CheckToken("plain"), "plaintext token must be accepted")
+	assert.True(t, cf.CheckToken("hashed"), "hashed token must be accepted")
+	assert.False(t, cf.CheckToken(hash), "the hash itself must be rejected")
+	assert.False(t, cf.CheckToken("plain2"), "wrong token must be rejected")
+}
+
+func TestLoadTokens(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "token")
+	assert.NoError(t, os.WriteFile(filename, []byte("fr0mf1le\n"), 0600))
+	t.Setenv("OPENQA_AGENT_TEST_TOKEN", "fr0men5")
+
+	var cf Config
+	cf.SetDefaults()
+	cf.Serial.SerialPort = "/dev/ttyS0:115200"
+	cf.Webserver.Token = []Token{{File: filename}, {Env: "OPENQA_AGENT_TEST_TOKEN"}}
+	assert.NoError(t, cf.LoadTokens(), "loading tokens should succeed")
+	assert.NoError(t, cf.SanityCheck(), "sanity check should pass with loaded tokens")
+	assert.True(t, cf.CheckToken("fr0mf1le"), "token from file must be accepted")
+	assert.True(t, cf.CheckToken("fr0men5"), "token from environment must be accepted")
+
+	cf.Webserver.Token = []Token{{File: filepath.Join(dir, "nonexisting")}}
+	assert.Error(t, cf.LoadTokens(), "missing token files should fail")
+	cf.Webserver.Token = []Token{{Env: "OPENQA_AGENT_TEST_NONEXISTING"}}
+	assert.Error(t, cf.LoadTokens(), "missing environment variables should fail")
+	cf.Webserver.Token = []Token{{Token: "plain", Env: "OPENQA_AGENT_TEST_TOKEN"}}
+	assert.Error(t, cf.LoadTokens(), "tokens with multiple sources should fail")
+
+	cf.Webserver.Token = []Token{{Hash: "$sha256$invalid"}}
+	assert.Error(t, cf.SanityCheck(), "sanity check must fail with invalid hashes")
+	cf.Webserver.Token = []Token{{Token: "plain", Hash: "$sha256$invalid"}}
+	assert.Error(t, cf.SanityCheck(), "sanity check must fail with token and hash")
+	cf.Webserver.Token = []Token{{}}
+	assert.Error(t, cf.SanityCheck(), "sanity check must fail with empty tokens")
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default lifetime of tokens created at runtime
+const DEFAULT_TOKEN_TTL = 1 * time.Hour
+
+// Length in bytes of the secrets of tokens created at runtime
+const TOKEN_SECRET_LENGTH = 32
+
+// StoredToken is a token created at runtime. The secret is only kept as hash
+type StoredToken struct {
+	ID      string    `yaml:"id"`      // Token identifier
+	Created time.Time `yaml:"created"` // Time of creation
+	Token   `yaml:",inline"`
+}
+
+// TokenStore holds the tokens created at runtime and optionally persists them in a state file.
+// The store is shared between all copies of the configuration.
+type TokenStore struct {
+	mutex  sync.Mutex
+	file   string        // State file or empty, if tokens are not persisted
+	tokens []StoredToken // Tokens in order of creation
+}
+
+// TokenRequest is the request object for creating a token at runtime
+type TokenRequest struct {
+	Name      string    `json:"name"`       // Optional name of the token
+	Scopes    []string  `json:"scopes"`     // Scopes of the token. Empty means all scopes
+	UIDs      []int     `json:"uids"`       // User IDs commands are allowed to run as
+	Paths     []string  `json:"paths"`      // Path prefixes accessible via the file API
+	Commands  []string  `json:"commands"`   // Executables that are allowed to run
+	TTL       int64     `json:"ttl"`        // Lifetime in seconds. Defaults to one hour, if no expiry time is given
+	NotBefore time.Time `json:"not_before"` // Optional time from which on the token is valid
+	Expires   time.Time `json:"expires"`    // Optional expiry time, instead of ttl
+}
+
+// TokenInfo describes a token created at runtime. The secret is only part of the reply when creating the token
+type TokenInfo struct {
+	ID        string    `json:"id"`                  // Token identifier
+	Name      string    `json:"name"`                // Identity name of the token
+	Token     string    `json:"token,omitempty"`     // Secret, only returned once on creation
+	Scopes    []string  `json:"scopes"`              // Scopes of the token. Empty means all scopes
+	UIDs      []int     `json:"uids,omitempty"`      // User IDs commands are allowed to run as
+	Paths     []string  `json:"paths,omitempty"`     // Path prefixes accessible via the file API
+	Commands  []string  `json:"commands,omitempty"`  // Executables that are allowed to run
+	Created   time.Time `json:"created"`             // Time of creation
+	NotBefore time.Time `json:"not_before,omitzero"` // Time from which on the token is valid
+	Expires   time.Time `json:"expires"`             // Expiry time
+}
+
+// Restrict limits the permissions to the restrictions of the given parent permissions. Missing restrictions are inherited from the parent.
+// Returns a PermissionDeniedError if the permissions exceed the ones of the parent
+func (p *Permissions) Restrict(parent Permissions) error {
+	if !slices.Contains(parent.Scopes, SCOPE_ADMIN) && len(parent.Scopes) > 0 {
+		if len(p.Scopes) == 0 {
+			p.Scopes = parent.Scopes
+		}
+		for _, scope := range p.Scopes {
+			if !parent.HasScope(scope) {
+				return fmt.Errorf("%w: scope %s", PermissionDeniedError, scope)
+			}
+		}
+	}
+	if len(parent.UIDs) > 0 {
+		if len(p.UIDs) == 0 {
+			p.UIDs = parent.UIDs
+		}
+		for _, uid := range p.UIDs {
+			if !slices.Contains(parent.UIDs, uid) {
+				return fmt.Errorf("%w: uid %d", PermissionDeniedError, uid)
+			}
+		}
+	}
+	if len(parent.Commands) > 0 {
+		if len(p.Commands) == 0 {
+			p.Commands = parent.Commands
+		}
+		for _, command := range p.Commands {
+			if !slices.Contains(parent.Commands, command) {
+				return fmt.Errorf("%w: command %s", PermissionDeniedError, command)
+			}
+		}
+	}
+	if len(parent.Paths) > 0 {
+		if len(p.Paths) == 0 {
+			p.Paths = parent.Paths
+		}
+		for _, path := range p.Paths {
+			resolved, err := ResolvePath(path)
+			if err != nil {
+				return err
+			}
+			if err := parent.CheckPath(resolved); err != nil {
+				return fmt.Errorf("%w: path %s", PermissionDeniedError, path)
+			}
+		}
+	}
+	return nil
+}
+
+// NewTokenStore creates a token store. If a state file is given, tokens are loaded from and persisted to it
+func NewTokenStore(file string) (*TokenStore, error) {
+	store := &TokenStore{file: file, tokens: make([]StoredToken, 0)}
+	if file == "" {
+		return store, nil
+	}
+	buf, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(buf, &store.tokens); err != nil {
+		return nil, fmt.Errorf("invalid token state file %s: %w", file, err)
+	}
+	store.prune(time.Now())
+	return store, nil
+}
+
+// prune removes expired tokens. The mutex must be held by the caller
+func (s *TokenStore) prune(now time.Time) {
+	s.tokens = slices.DeleteFunc(s.tokens, func(tok StoredToken) bool {
+		return !tok.Expires.IsZero() && !now.Before(tok.Expires)
+	})
+}
+
+// save writes the tokens to the state file, if any. The mutex must be held by the caller
+func (s *TokenStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	buf, err := yaml.Marshal(s.tokens)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil {
+		return err
+	}
+	_, err = WriteFileAtomic(s.file, bytes.NewReader(buf), 0600, "")
+	return err
+}
+
+// Create adds a new token with the given name, permissions and validity. Returns the stored token and its secret
+func (s *TokenStore) Create(name string, permissions Permissions, notBefore time.Time, expires time.Time) (StoredToken, string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return StoredToken{}, "", err
+	}
+	id := hex.EncodeToString(buf)
+	buf = make([]byte, TOKEN_SECRET_LENGTH)
+	if _, err := rand.Read(buf); err != nil {
+		return StoredToken{}, "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	// Random secrets have enough entropy for a fast hash
+	hash, err := HashToken(secret, "sha256")
+	if err != nil {
+		return StoredToken{}, "", err
+	}
+	if name == "" {
+		name = id
+	}
+	tok := StoredToken{ID: id, Created: time.Now().UTC(), Token: Token{Name: name, Hash: hash, NotBefore: notBefore, Expires: expires, Permissions: permissions}}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.prune(time.Now())
+	s.tokens = append(s.tokens, tok)
+	if err := s.save(); err != nil {
+		s.tokens = s.tokens[:len(s.tokens)-1]
+		return StoredToken{}, "", err
+	}
+	return tok, secret, nil
+}
+
+// List returns all tokens, that have not expired yet
+func (s *TokenStore) List() []StoredToken {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.prune(time.Now())
+	return slices.Clone(s.tokens)
+}
+
+// Revoke removes the token with the given identifier. Returns false, if the token does not exist
+func (s *TokenStore) Revoke(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	i := slices.IndexFunc(s.tokens, func(tok StoredToken) bool { return tok.ID == id })
+	if i < 0 {
+		return false, nil
+	}
+	s.tokens = slices.Delete(s.tokens, i, i+1)
+	s.prune(time.Now())
+	return true, s.save()
+}
+
+// Identity returns the identity of the given secret, if it belongs to a valid token
+func (s *TokenStore) Identity(secret string) (Identity, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for _, tok := range s.tokens {
+		if tok.IsValid(now) && VerifyTokenHash(secret, tok.Hash) {
+			return Identity{Name: tok.Name, Method: AUTH_TOKEN, Permissions: tok.Permissions}, true
+		}
+	}
+	return Identity{}, false
+}
+
+// tokenInfo returns the description of the given stored token
+func tokenInfo(tok StoredToken) TokenInfo {
+	scopes := tok.Permissions.Scopes
+	if scopes == nil {
+		scopes = make([]string, 0)
+	}
+	return TokenInfo{ID: tok.ID, Name: tok.Name, Scopes: scopes, UIDs: tok.Permissions.UIDs, Paths: tok.Permissions.Paths, Commands: tok.Permissions.Commands,
+		Created: tok.Created, NotBefore: tok.NotBefore, Expires: tok.Expires}
+}
+
+// writeJSON writes the given object as json reply
+func writeJSON(w http.ResponseWriter, code int, value any) {
+	if buf, err := json.Marshal(value); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+	} else {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write(buf)
+	}
+}
+
+// createTokenHandler create a new http handler for creating tokens at runtime. The token cannot exceed the permissions of its creator
+func createTokenHandler(cf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cf.Webserver.Tokens == nil {
+			writeError(w, http.StatusNotFound, "token management not available")
+			return
+		}
+		var req TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		now := time.Now()
+		expires := req.Expires
+		if req.TTL < 0 || (req.TTL > 0 && !req.Expires.IsZero()) {
+			writeError(w, http.StatusBadRequest, "invalid ttl")
+			return
+		} else if req.TTL > 0 {
+			expires = now.Add(time.Duration(req.TTL) * time.Second)
+		} else if expires.IsZero() {
+			expires = now.Add(DEFAULT_TOKEN_TTL)
+		}
+		if !expires.After(now) || (!req.NotBefore.IsZero() && !req.NotBefore.Before(expires)) {
+			writeError(w, http.StatusBadRequest, "token would never be valid")
+			return
+		}
+		permissions := Permissions{Scopes: req.Scopes, UIDs: req.UIDs, Paths: req.Paths, Commands: req.Commands}
+		if err := permissions.SanityCheck(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := permissions.Restrict(requestPermissions(r)); err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+
+		tok, secret, err := cf.Webserver.Tokens.Create(req.Name, permissions, req.NotBefore.UTC(), expires.UTC())
+		if err != nil {
+			writeErrorReply(w, http.StatusInternalServerError, ErrorReply{Code: ERR_IO, Error: err.Error()})
+			return
+		}
+		info := tokenInfo(tok)
+		info.Token = secret
+		w.Header().Add("Location", API_V1_PREFIX+"/tokens/"+tok.ID)
+		writeJSON(w, http.StatusCreated, info)
+	})
+}
+
+// listTokensHandler create a new http handler for listing the tokens created at runtime, without their secrets
+func listTokensHandler(cf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens := make([]TokenInfo, 0)
+		if cf.Webserver.Tokens != nil {
+			for _, tok := range cf.Webserver.Tokens.List() {
+				tokens = append(tokens, tokenInfo(tok))
+			}
+		}
+		writeJSON(w, http.StatusOK, tokens)
+	})
+}
+
+// revokeTokenHandler create a new http handler for revoking tokens created at runtime
+func revokeTokenHandler(cf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cf.Webserver.Tokens == nil {
+			writeError(w, http.StatusNotFound, "token not found")
+			return
+		}
+		found, err := cf.Webserver.Tokens.Revoke(r.PathValue("id"))
+		if !found {
+			writeError(w, http.StatusNotFound, "token not found")
+			return
+		} else if err != nil {
+			// The token is revoked nonetheless, but will be valid again after a restart
+			writeErrorReply(w, http.StatusInternalServerError, ErrorReply{Code: ERR_IO, Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
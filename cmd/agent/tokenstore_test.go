@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenExpiry(t *testing.T) {
+	now := time.Now()
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Token = []Token{
+		{Token: "expired", Expires: now.Add(-1 * time.Minute)},
+		{Token: "future", NotBefore: now.Add(1 * time.Minute)},
+		{Token: "valid", NotBefore: now.Add(-1 * time.Minute), Expires: now.Add(1 * time.Minute)},
+	}
+	assert.False(t, cf.CheckToken("expired"), "expired tokens must be rejected")
+	assert.False(t, cf.CheckToken("future"), "tokens must be rejected before their validity")
+	assert.True(t, cf.CheckToken("valid"), "tokens within their validity must be accepted")
+
+	cf.Serial.SerialPort = "/dev/ttyS0:115200"
+	cf.Webserver.Token = []Token{{Token: "never", NotBefore: now, Expires: now.Add(-1 * time.Minute)}}
+	assert.Error(t, cf.SanityCheck(), "sanity check must fail with tokens that are never valid")
+}
+
+func TestTokenStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state", "tokens.yaml")
+	store, err := NewTokenStore(file)
+	assert.NoError(t, err, "missing state files should be fine")
+
+	tok, secret, err := store.Create("job-42", Permissions{Scopes: []string{SCOPE_EXEC}}, time.Time{}, time.Now().Add(1*time.Hour))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, secret)
+	assert.NotContains(t, tok.Hash, secret, "secrets must only be stored as hash")
+	_, _, err = store.Create("expired", Permissions{}, time.Time{}, time.Now().Add(-1*time.Second))
+	assert.NoError(t, err)
+	identity, ok := store.Identity(secret)
+	assert.True(t, ok, "created tokens must be valid")
+	assert.Equal(t, Identity{Name: "job-42", Method: AUTH_TOKEN, Permissions: Permissions{Scopes: []string{SCOPE_EXEC}}}, identity)
+	assert.Len(t, store.List(), 1, "expired tokens must not be listed")
+
+	// Tokens survive restarts via the state file
+	restored, err := NewTokenStore(file)
+	assert.NoError(t, err)
+	_, ok = restored.Identity(secret)
+	assert.True(t, ok, "tokens must be restored from the state file")
+	found, err := restored.Revoke(tok.ID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	_, ok = restored.Identity(secret)
+	assert.False(t, ok, "revoked tokens must be rejected")
+	found, _ = restored.Revoke(tok.ID)
+	assert.False(t, found, "revoking twice should fail")
+	restored, err = NewTokenStore(file)
+	assert.NoError(t, err)
+	assert.Empty(t, restored.List(), "revocations must be persisted")
+}
+
+func TestTokenEndpoints(t *testing.T) {
+	store, err := NewTokenStore("")
+	assert.NoError(t, err)
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Token = []Token{{Token: "admin"}, {Token: "scheduler", Permissions: Permissions{Scopes: []string{SCOPE_ADMIN}, UIDs: []int{1000}}}, {Token: "reader", Permissions: Permissions{Scopes: []string{SCOPE_FILE_READ}}}}
+	cf.Webserver.Tokens = store
+	mux := http.NewServeMux()
+	registerRoutes(mux, cf)
+
+	request := func(method string, path string, body string, token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Token", token)
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusForbidden, request("POST", "/v1/tokens", `{}`, "reader").Code, "creating tokens should require the admin scope")
+	assert.Equal(t, http.StatusBadRequest, request("POST", "/v1/tokens", `{"ttl":-1}`, "admin").Code)
+	assert.Equal(t, http.StatusBadRequest, request("POST", "/v1/tokens", `{"scopes":["root"]}`, "admin").Code)
+	assert.Equal(t, http.StatusForbidden, request("POST", "/v1/tokens", `{"uids":[0]}`, "scheduler").Code, "tokens must not exceed the permissions of their creator")
+
+	rec := request("POST", "/v1/tokens", `{"name":"job-42","scopes":["exec"],"ttl":60}`, "scheduler")
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var info TokenInfo
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	assert.NotEmpty(t, info.Token, "the secret should be returned on creation")
+	assert.Equal(t, []int{1000}, info.UIDs, "restrictions of the creator should be inherited")
+	assert.WithinDuration(t, time.Now().Add(60*time.Second), info.Expires, 5*time.Second)
+	assert.Equal(t, "/v1/tokens/"+info.ID, rec.Header().Get("Location"))
+
+	assert.Equal(t, http.StatusForbidden, request("POST", "/v1/exec", `{"cmd":"true"}`, info.Token).Code, "created tokens should carry their restrictions")
+	assert.Equal(t, http.StatusForbidden, request("GET", "/v1/tokens", "", info.Token).Code, "created tokens should carry their scopes")
+
+	rec = request("GET", "/v1/tokens", "", "admin")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), info.Token, "secrets must not be listed")
+	var tokens []TokenInfo
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tokens))
+	assert.Len(t, tokens, 1)
+	assert.Equal(t, "job-42", tokens[0].Name)
+
+	assert.Equal(t, http.StatusNoContent, request("DELETE", "/v1/tokens/"+info.ID, "", "admin").Code)
+	assert.Equal(t, http.StatusNotFound, request("DELETE", "/v1/tokens/"+info.ID, "", "admin").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/v1/capabilities", "", info.Token).Code, "revoked tokens must be rejected")
+}
+
+func TestRestrictPermissions(t *testing.T) {
+	dir := t.TempDir()
+	parent := Permissions{Scopes: []string{SCOPE_ADMIN}, UIDs: []int{1000}, Paths: []string{dir}, Commands: []string{"ls"}}
+	p := Permissions{}
+	assert.NoError(t, p.Restrict(parent))
+	assert.Equal(t, Permissions{UIDs: []int{1000}, Paths: []string{dir}, Commands: []string{"ls"}}, p, "restrictions should be inherited")
+	p = Permissions{Paths: []string{filepath.Join(dir, "sub")}}
+	assert.NoError(t, p.Restrict(parent), "narrower paths should be allowed")
+	p = Permissions{Paths: []string{filepath.Join(dir, "..")}}
+	assert.ErrorIs(t, p.Restrict(parent), PermissionDeniedError, "wider paths should be denied")
+	p = Permissions{Commands: []string{"rm"}}
+	assert.ErrorIs(t, p.Restrict(parent), PermissionDeniedError)
+	p = Permissions{Scopes: []string{SCOPE_EXEC}}
+	assert.ErrorIs(t, p.Restrict(Permissions{Scopes: []string{SCOPE_FILE_READ}}), PermissionDeniedError)
+	assert.NoError(t, p.Restrict(Permissions{}), "unrestricted parents should allow everything")
+}
@@ -2,7 +2,15 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 // CommandSplit splits a command into program arguments and obeys quotation marks
@@ -57,3 +65,104 @@ func ReadPipe(reader io.ReadCloser, writer *bytes.Buffer, limit int) error {
 		}
 	}
 }
+
+// Maximum number of symlinks followed when resolving a path
+const MAX_SYMLINKS = 255
+
+// ResolvePath returns the absolute path of the given path with all symlinks and '..' elements resolved.
+// Non-existing trailing elements are kept as they are, so that files to be created can be resolved as well.
+// Dangling symlinks are followed to their target, as creating a file via them would create the target.
+func ResolvePath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		var err error
+		if path, err = filepath.Abs(path); err != nil {
+			return "", err
+		}
+	}
+	separator := string(filepath.Separator)
+	volume := filepath.VolumeName(path)
+	resolved := volume + separator
+	remaining := path[len(volume):]
+	links := 0
+	for remaining != "" {
+		var element string
+		element, remaining, _ = strings.Cut(remaining, separator)
+		switch element {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, element)
+		info, err := os.Lstat(next)
+		if errors.Is(err, fs.ErrNotExist) {
+			resolved = next
+			continue
+		} else if err != nil {
+			return "", err
+		} else if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > MAX_SYMLINKS {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", path)
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			volume = filepath.VolumeName(target)
+			resolved = volume + separator
+			target = target[len(volume):]
+		}
+		remaining = target + separator + remaining
+	}
+	return resolved, nil
+}
+
+// WriteFileAtomic writes the contents of reader into a temporary file next to the given path and moves it into place once completed.
+// If checksum is not empty, it must be in the form 'algo:hex' and the written data is verified against it.
+// On errors the temporary file is removed and the destination remains untouched. Returns the number of written bytes.
+func WriteFileAtomic(path string, reader io.Reader, mode os.FileMode, checksum string) (int64, error) {
+	var h hash.Hash
+	expected := ""
+	if checksum != "" {
+		algo, sum, err := ParseChecksum(checksum)
+		if err != nil {
+			return 0, err
+		}
+		expected = sum
+		if h, err = newHash(algo); err != nil {
+			return 0, err
+		}
+		reader = io.TeeReader(reader, h)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.part")
+	if err != nil {
+		return 0, err
+	}
+	// Remove the temporary file on any error. This is a no-op once the file has been moved into place
+	defer os.Remove(file.Name())
+	written, err := io.Copy(file, reader)
+	if err != nil {
+		file.Close()
+		return written, err
+	}
+	if err := file.Close(); err != nil {
+		return written, err
+	}
+	if h != nil {
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+			return written, fmt.Errorf("%w: expected %s, got %s", ChecksumMismatchError, expected, actual)
+		}
+	}
+	if err := os.Chmod(file.Name(), mode); err != nil {
+		return written, err
+	}
+	return written, os.Rename(file.Name(), path)
+}
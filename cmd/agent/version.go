@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// API versions. Requests without an explicit version get the legacy status codes of the original API
+const (
+	API_LEGACY = 0
+	API_V1     = 1
+	API_LATEST = API_V1
+)
+
+// UnsupportedVersionError occurs when a client requests an unknown API version
+var UnsupportedVersionError = errors.New("unsupported api version")
+
+// Context key of the API version of a request
+type apiVersionKey struct{}
+
+// parseAPIVersion parses the value of an 'Api-Version' header, e.g. '1' or 'v1'. An empty value is the legacy version
+func parseAPIVersion(value string) (int, error) {
+	value = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(value)), "v")
+	if value == "" {
+		return API_LEGACY, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < API_LEGACY || version > API_LATEST {
+		return 0, UnsupportedVersionError
+	}
+	return version, nil
+}
+
+// withAPIVersion returns a shallow copy of the request with the given API version
+func withAPIVersion(r *http.Request, version int) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version))
+}
+
+// apiVersion returns the API version of the given request
+func apiVersion(r *http.Request) int {
+	if version, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return version
+	}
+	version, _ := parseAPIVersion(r.Header.Get("Api-Version"))
+	return version
+}
+
+// apiVersionHandler determines the API version of a request from its 'Api-Version' header and rejects unsupported versions.
+// Versioned replies carry the version in the 'Api-Version' header as well.
+func apiVersionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version, err := parseAPIVersion(r.Header.Get("Api-Version"))
+		if err != nil {
+			writeErrorReply(w, http.StatusBadRequest, ErrorReply{Code: ERR_UNSUPPORTED_VERSION, Error: err.Error(), Details: map[string]any{"latest": API_LATEST}})
+			return
+		}
+		if version > API_LEGACY {
+			w.Header().Set("Api-Version", strconv.Itoa(version))
+		}
+		next.ServeHTTP(w, withAPIVersion(r, version))
+	})
+}
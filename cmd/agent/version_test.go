@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAPIVersion(t *testing.T) {
+	for value, expected := range map[string]int{"": API_LEGACY, "0": API_LEGACY, "1": API_V1, "v1": API_V1, " V1 ": API_V1} {
+		version, err := parseAPIVersion(value)
+		assert.NoError(t, err, "parsing '%s' should succeed", value)
+		assert.Equal(t, expected, version, "version of '%s'", value)
+	}
+	for _, value := range []string{"-1", "999", "latest", "1.0"} {
+		_, err := parseAPIVersion(value)
+		assert.ErrorIs(t, err, UnsupportedVersionError, "parsing '%s' should fail", value)
+	}
+}
+
+func TestAPIVersionHandler(t *testing.T) {
+	var version int
+	handler := apiVersionHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version = apiVersion(r)
+	}))
+	request := func(header string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/health", nil)
+		if header != "" {
+			req.Header.Set("Api-Version", header)
+		}
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("")
+	assert.Equal(t, API_LEGACY, version, "requests without header should use the legacy api")
+	assert.Empty(t, rec.Header().Get("Api-Version"))
+	rec = request("1")
+	assert.Equal(t, API_V1, version)
+	assert.Equal(t, "1", rec.Header().Get("Api-Version"), "versioned replies should carry the version")
+	rec = request("42")
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "unsupported versions should be rejected")
+	assert.Equal(t, ERR_UNSUPPORTED_VERSION, decodeError(t, rec).Code)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchEvent is a single filesystem change event
+type WatchEvent struct {
+	Time  time.Time `json:"time"`  // Time when the event was received
+	Path  string    `json:"path"`  // Affected path
+	Event string    `json:"event"` // One of create, modify, delete, rename or chmod
+}
+
+// watchEventName returns the name of the given fsnotify operation
+func watchEventName(op fsnotify.Op) string {
+	switch {
+	case op.Has(fsnotify.Create):
+		return "create"
+	case op.Has(fsnotify.Write):
+		return "modify"
+	case op.Has(fsnotify.Remove):
+		return "delete"
+	case op.Has(fsnotify.Rename):
+		return "rename"
+	case op.Has(fsnotify.Chmod):
+		return "chmod"
+	default:
+		return op.String()
+	}
+}
+
+// addWatchRecursive adds watches for the given directory and all its subdirectories
+func addWatchRecursive(watcher *fsnotify.Watcher, dir string, allowed func(path string) bool) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Directories might disappear while walking
+			if errors.Is(err, fs.ErrNotExist) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if allowed != nil && !allowed(path) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// watchHandler create a new http handler for watching files and directories for changes.
+// Events are streamed as newline-delimited json objects until the client disconnects or the timeout passes.
+func watchHandler(cf Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := r.URL.Query()
+		paths := values["path"]
+		if len(paths) <= 0 || paths[0] == "" {
+			writeError(w, http.StatusBadRequest, "missing 'path' argument")
+			return
+		}
+		recursive := false
+		if value := values.Get("recursive"); value != "" {
+			var err error
+			if recursive, err = strconv.ParseBool(value); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid recursive")
+				return
+			}
+		}
+		// Optional timeout in seconds after which watching stops
+		var timeout <-chan time.Time
+		if value := values.Get("timeout"); value != "" {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid timeout")
+				return
+			}
+			timeout = time.After(time.Duration(seconds) * time.Second)
+		}
+
+		path, err := checkReadPath(r, cf, paths[0])
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+
+		// Files are watched via their parent directory, so that replaced and not yet existing files can be watched as well
+		dir := path
+		single := false
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			if err != nil && !os.IsNotExist(err) {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			dir = filepath.Dir(path)
+			single = true
+			recursive = false
+		}
+
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer watcher.Close()
+		if recursive {
+			err = addWatchRecursive(watcher, dir, cf.Webserver.Files.CanRead)
+		} else {
+			err = watcher.Add(dir)
+		}
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+
+		// Send the headers right away, so that the client knows that the watch is active
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		controller := http.NewResponseController(w)
+		if err := controller.Flush(); err != nil {
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-timeout:
+				return
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("watch: error while watching '%s': %s", path, err)
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if single && event.Name != path {
+					continue
+				}
+				if !cf.Webserver.Files.CanRead(event.Name) {
+					continue
+				}
+				// Newly created directories need to be watched as well
+				if recursive && event.Has(fsnotify.Create) {
+					if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+						if err := addWatchRecursive(watcher, event.Name, cf.Webserver.Files.CanRead); err != nil {
+							log.Printf("watch: error while watching '%s': %s", event.Name, err)
+						}
+					}
+				}
+				if err := encoder.Encode(WatchEvent{Time: time.Now(), Path: event.Name, Event: watchEventName(event.Op)}); err != nil {
+					return
+				}
+				if err := controller.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	})
+}
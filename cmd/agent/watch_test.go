@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	assert.NoError(t, err)
+	var cf Config
+	cf.SetDefaults()
+	server := httptest.NewServer(watchHandler(cf))
+	// Close the server only after all watch requests are cancelled
+	t.Cleanup(server.Close)
+
+	// Start watching and return a function to receive the next event
+	watch := func(values url.Values) func() WatchEvent {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		t.Cleanup(cancel)
+		req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/watch?"+values.Encode(), nil)
+		assert.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err, "watch request should succeed") {
+			t.FailNow()
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		decoder := json.NewDecoder(res.Body)
+		return func() WatchEvent {
+			var event WatchEvent
+			assert.NoError(t, decoder.Decode(&event), "receiving event should succeed")
+			return event
+		}
+	}
+
+	// Recursive directory watch
+	next := watch(url.Values{"path": {dir}, "recursive": {"true"}})
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	event := next()
+	assert.Equal(t, "create", event.Event)
+	assert.Equal(t, filepath.Join(dir, "sub"), event.Path)
+	// Wait until the new directory is being watched
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "core.dump"), []byte("core"), 0644))
+	event = next()
+	assert.Equal(t, "create", event.Event, "files in new subdirectories should be watched")
+	assert.Equal(t, filepath.Join(dir, "sub", "core.dump"), event.Path)
+	event = next()
+	assert.Equal(t, "modify", event.Event)
+	assert.NoError(t, os.Remove(filepath.Join(dir, "sub", "core.dump")))
+	event = next()
+	assert.Equal(t, "delete", event.Event)
+
+	// Watching a single, not yet existing file
+	lock := filepath.Join(dir, "test.lock")
+	next = watch(url.Values{"path": {lock}})
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0644))
+	assert.NoError(t, os.WriteFile(lock, []byte{}, 0644))
+	event = next()
+	assert.Equal(t, "create", event.Event)
+	assert.Equal(t, lock, event.Path, "events of other files should be filtered")
+
+	// Timeout
+	res, err := http.Get(server.URL + "/watch?" + url.Values{"path": {dir}, "timeout": {"1"}}.Encode())
+	assert.NoError(t, err)
+	assert.Error(t, json.NewDecoder(res.Body).Decode(&event), "watch should end after timeout")
+	res.Body.Close()
+
+	// Error handling
+	res, err = http.Get(server.URL + "/watch?" + url.Values{"path": {filepath.Join(dir, "nonexisting", "file")}}.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "watching non-existing directories should fail")
+	res.Body.Close()
+	res, err = http.Get(server.URL + "/watch")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "missing path should be rejected")
+	res.Body.Close()
+}
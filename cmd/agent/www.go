@@ -5,26 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"os/exec"
+	"strconv"
 )
 
-// checkToken checks the given request for a valid authentication token. If not present it rejects the request.
-func checkTokenHandler(next http.Handler, cf Config) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		for _, token := range r.Header["Token"] {
-			if cf.CheckToken(token) {
-				next.ServeHTTP(w, r)
-				return
-			}
-		}
-		// Deny request
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprintf(w, "{\"error\":\"denied\"}")
-	})
-}
-
 // execHandler create a new http handler for executing commands
 func execHandler(cf Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -32,41 +20,72 @@ func execHandler(cf Config) http.Handler {
 		job.SetDefaults()
 		job.Shell = cf.DefaultShell
 		job.WorkDir = cf.DefaultWorkDir
+		job.Timeout = cf.Policy.DefaultTimeout(job.Timeout)
 		if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "{\"error\":\"%s\"}", err)
+			writeErrorReply(w, http.StatusBadRequest, ErrorReply{Code: ERR_INVALID_JOB, Error: err.Error()})
 			return
 		}
 
+		rec := requestAudit(r)
+		rec.SetJob(&job)
+
 		// Sanity checks
 		if err := job.SanityCheck(); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "{\"error\":\"%s\"}", err)
+			rec.SetError(err)
+			writeErrorReply(w, http.StatusBadRequest, ErrorReply{Code: ERR_INVALID_JOB, Error: err.Error()})
+			return
+		}
+		if err := cf.Policy.CheckJob(&job); err != nil {
+			rec.SetError(err)
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		permissions := requestPermissions(r)
+		if err := permissions.CheckJob(&job); err != nil {
+			rec.SetError(err)
+			writeError(w, http.StatusForbidden, err.Error())
 			return
 		}
 
-		// Execute the command and collect the state. On TimeoutErrors we continue but will return a 524 status code
-		returnCode := http.StatusAccepted
-		if err := job.exec(); err != nil {
+		// Execute the command and collect the state. On TimeoutErrors we continue but flag the reply and return a timeout status code.
+		// Legacy clients get 202 for completed commands and 524 on timeouts
+		version := apiVersion(r)
+		var reply Reply
+		returnCode := http.StatusOK
+		if version == API_LEGACY {
+			returnCode = http.StatusAccepted
+		}
+		err := job.exec()
+		rec.SetError(err)
+		if err != nil {
 			if errors.Is(err, TimeoutError) {
-				returnCode = 524
+				reply.Timeout = true
+				returnCode = http.StatusGatewayTimeout
+				if version == API_LEGACY {
+					returnCode = 524
+				}
+			} else if version == API_LEGACY {
+				writeErrorReply(w, http.StatusBadRequest, ErrorReply{Code: ERR_EXEC_FAILED, Error: err.Error()})
+				return
+			} else if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+				writeError(w, http.StatusNotFound, err.Error())
+				return
 			} else {
-				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintf(w, "{\"error\":\"%s\"}", err)
+				writeErrorReply(w, http.StatusInternalServerError, ErrorReply{Code: ERR_EXEC_FAILED, Error: err.Error()})
 				return
 			}
 		}
 
-		var reply Reply
+		rec.SetReturnCode(job.ret)
 		reply.Command = job.Command
+		reply.Shell = job.Shell
 		reply.Runtime = job.runtime
 		reply.ReturnCode = job.ret
 		reply.StdOut = string(job.stdout)
 		reply.StdErr = string(job.stderr)
 
 		if buf, err := json.Marshal(reply); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "{\"error\":\"%s\"}", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		} else {
 			w.Header().Add("Content-Type", "application/json")
@@ -76,127 +95,235 @@ func execHandler(cf Config) http.Handler {
 	})
 }
 
+// fileETag computes a strong ETag of a file based on its size and modification time
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+}
+
 // getFileHandler create a new http handler for pulling files from the host
-func getFileHandler() http.Handler {
+// Range and If-Range requests are supported to resume interrupted transfers
+func getFileHandler(cf Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		values := r.URL.Query()
 		paths := values["path"]
 		if len(paths) <= 0 || paths[0] == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "{\"error\":\"missing 'path' argument\"}")
+			writeError(w, http.StatusBadRequest, "missing 'path' argument")
 			return
 		}
-		file, err := os.OpenFile(paths[0], os.O_RDONLY, 0600)
+		filename, err := checkReadPath(r, cf, paths[0])
 		if err != nil {
-			if os.IsNotExist(err) {
-				w.WriteHeader(http.StatusNotFound)
-				fmt.Fprintf(w, "{\"error\":\"file not found\"}")
-				return
-			}
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "{\"error\":\"%s\"}", err)
+			writeFileError(w, err)
 			return
 		}
-		defer file.Close()
-		// Get file size
-		size, err := file.Seek(0, 2)
+		file, err := os.OpenFile(filename, os.O_RDONLY, 0600)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "{\"error\":\"%s\"}", err)
+			writeFileError(w, err)
 			return
 		}
-		_, err = file.Seek(0, 0)
+		defer file.Close()
+		info, err := file.Stat()
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "{\"error\":\"%s\"}", err)
+			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		w.Header().Add("Content-Length", fmt.Sprintf("%d", size))
-		w.Header().Add("Content-Type", "application/octet-stream")
-		w.Header().Add("Content-Disposition", "attachment")
-		w.WriteHeader(http.StatusAccepted)
-
-		buf := make([]byte, 4096)
-		for {
-			n, err := file.Read(buf)
-			// Always write the data first
-			if n > 0 {
-				if _, err := w.Write(buf[:n]); err != nil {
-					// Assume connection has been closed and don't do anything
-					return
-				}
-			}
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					break
-				} else {
-					log.Fatalf("io error while reading '%s': %s", paths[0], err)
-					return
-				}
-			}
+		if info.IsDir() {
+			writeError(w, http.StatusBadRequest, "path is a directory")
+			return
 		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment")
+		w.Header().Set("ETag", fileETag(info))
+		// ServeContent handles Range, If-Range and conditional requests and sets Last-Modified. Legacy clients get 202 for full replies
+		if apiVersion(r) == API_LEGACY {
+			w = &acceptedWriter{ResponseWriter: w}
+		}
+		http.ServeContent(w, r, "", info.ModTime(), file)
 	})
 }
 
+// acceptedWriter replies 202 instead of 200, as expected by legacy clients
+type acceptedWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (aw *acceptedWriter) WriteHeader(code int) {
+	if code == http.StatusOK {
+		code = http.StatusAccepted
+	}
+	aw.wroteHeader = true
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *acceptedWriter) Write(buf []byte) (int, error) {
+	if !aw.wroteHeader {
+		aw.WriteHeader(http.StatusOK)
+	}
+	return aw.ResponseWriter.Write(buf)
+}
+
+// Unwrap allows http.ResponseController to access the underlying http.ResponseWriter
+func (aw *acceptedWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
 // putFileHandler create a new http handler for pushing files to the host
-func putFileHandler() http.Handler {
+// If the 'offset' argument is present, the body is written at the given offset to resume an interrupted upload
+func putFileHandler(cf Config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		values := r.URL.Query()
 		paths := values["path"]
 		if len(paths) <= 0 || paths[0] == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "{\"error\":\"missing 'path' argument\"}")
+			writeError(w, http.StatusBadRequest, "missing 'path' argument")
 			return
 		}
 
 		if r.Body == nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "{\"error\":\"missing body\"}")
+			writeError(w, http.StatusBadRequest, "missing body")
 			return
 		}
-
-		// By default create or overwrite a file, and set the permissions to 0644
-		var mode os.FileMode = 0644
-		flag := os.O_WRONLY | os.O_CREATE
-		file, err := os.OpenFile(paths[0], flag, mode)
+		filename, err := checkWritePath(r, cf, paths[0])
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "{\"error\":\"%s\"}", err)
+			writeFileError(w, err)
 			return
 		}
-		defer file.Close()
+		body, err := requestBody(r)
+		if err != nil {
+			if errors.Is(err, UnsupportedEncodingError) {
+				writeError(w, http.StatusUnsupportedMediaType, err.Error())
+			} else {
+				writeError(w, http.StatusBadRequest, err.Error())
+			}
+			return
+		}
+		// Limit the decoded body as well, compressed uploads might expand beyond the limit
+		body = limitBody(w, body, cf)
+		defer body.Close()
 
-		// Write body to file
-		buf := make([]byte, 4096)
-		var received uint64
-		for {
-			n, err := r.Body.Read(buf)
-			// Always write the data first
-			if n > 0 {
-				if _, err := file.Write(buf[:n]); err != nil {
-					log.Fatalf("io error while writing '%s': %s", paths[0], err)
-					w.WriteHeader(http.StatusInternalServerError)
-					fmt.Fprintf(w, "{\"error\":\"%s\"}", err)
-					return
-				}
-				received += uint64(n)
+		var offset int64 = -1
+		if value := values.Get("offset"); value != "" {
+			var err error
+			offset, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || offset < 0 {
+				writeError(w, http.StatusBadRequest, "invalid offset")
+				return
+			}
+		}
+
+		// Record receive errors to tell them apart from errors writing to disk
+		reader := &receiveReader{Reader: body}
+		var received int64
+		if offset >= 0 {
+			// Resume upload: The offset must not leave a gap in the file. Discard everything after the offset
+			file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
 			}
+			defer file.Close()
+			info, err := file.Stat()
 			if err != nil {
-				if errors.Is(err, io.EOF) {
-					break
-				} else {
-					log.Fatalf("io error while receiving '%s': %s", paths[0], err)
-					w.WriteHeader(http.StatusInternalServerError)
-					fmt.Fprintf(w, "{\"error\":\"%s\"}", err)
-					return
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if offset > info.Size() {
+				writeErrorReply(w, http.StatusRequestedRangeNotSatisfiable, ErrorReply{Error: "offset beyond end of file", Details: map[string]any{"size": info.Size()}})
+				return
+			}
+			if err := file.Truncate(offset); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			// Data received before an error is kept, so that the client can resume from the reported size
+			received, err = io.Copy(file, reader)
+			if err == nil {
+				err = file.Close()
+			}
+			if err != nil {
+				uploadError(w, paths[0], err, reader.err != nil, received, offset+received)
+				return
+			}
+		} else if existing, err := os.Lstat(filename); err == nil && existing.Mode()&os.ModeSymlink == 0 && (!existing.Mode().IsRegular() || linkCount(existing) > 1) {
+			// Devices, FIFOs, /proc and /sys entries and hard links are written in place, replacing them would change their meaning.
+			// Symlinks have been resolved by checkWritePath and must never be followed here
+			offset = 0
+			file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				writeFileError(w, err)
+				return
+			}
+			defer file.Close()
+			received, err = io.Copy(file, reader)
+			if err == nil {
+				err = file.Close()
+			}
+			if err != nil {
+				uploadError(w, paths[0], err, reader.err != nil, received, received)
+				return
+			}
+		} else {
+			// Write regular files into a temporary file, so that failed uploads leave neither partial files nor a damaged destination.
+			// Overwritten files keep their permissions and ownership, new files are created with 0644
+			var mode os.FileMode = 0644
+			if existing != nil && existing.Mode().IsRegular() {
+				mode = existing.Mode().Perm()
+			}
+			offset = 0
+			received, err = WriteFileAtomic(filename, reader, mode, "")
+			if err != nil {
+				uploadError(w, paths[0], err, reader.err != nil, received, 0)
+				return
+			}
+			if existing != nil && existing.Mode().IsRegular() {
+				if err := chownLike(filename, existing); err != nil {
+					log.Printf("error restoring ownership of '%s': %s", paths[0], err)
 				}
 			}
 		}
-		w.WriteHeader(http.StatusAccepted)
-		fmt.Fprintf(w, "{\"status\":\"ok\",\"received\":%d}", received)
+		// Legacy clients get 202 for completed uploads
+		if apiVersion(r) == API_LEGACY {
+			w.WriteHeader(http.StatusAccepted)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		fmt.Fprintf(w, "{\"status\":\"ok\",\"received\":%d,\"size\":%d}", received, offset+received)
 	})
 }
 
+// receiveReader wraps a request body and records errors while receiving it
+type receiveReader struct {
+	io.Reader
+	err error // First error of the underlying reader, except io.EOF
+}
+
+func (r *receiveReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// uploadError logs and replies a failed upload. The request fails, but the agent keeps running.
+// Receive errors (e.g. client disconnects or corrupt compressed bodies) are client errors, write errors are server errors.
+func uploadError(w http.ResponseWriter, path string, err error, receiving bool, received int64, size int64) {
+	status, code := http.StatusInternalServerError, ERR_IO
+	if receiving {
+		log.Printf("io error while receiving '%s': %s", path, err)
+		status, code = http.StatusBadRequest, ERR_RECEIVE_FAILED
+	} else {
+		log.Printf("io error while writing '%s': %s", path, err)
+	}
+	if limited := uploadErrorStatus(err, 0); limited != 0 {
+		status, code = limited, errorCode(limited)
+	}
+	writeErrorReply(w, status, ErrorReply{Code: code, Error: err.Error(), Details: map[string]any{"received": received, "size": size}})
+}
+
 // healthHandler create a new http handler for checking the health of the agent
 func healthHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -1,9 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/stretchr/testify/assert"
@@ -63,3 +72,274 @@ func TestTokenHandler(t *testing.T) {
 	assert.NoError(t, err, "checkRequest should succeed")
 	assert.Equal(t, res, http.StatusAccepted, "requests with correct token 2 should succeed")
 }
+
+func TestExecStatus(t *testing.T) {
+	var cf Config
+	cf.SetDefaults()
+	handler := apiVersionHandler(execHandler(cf))
+
+	run := func(version string, job string) (*httptest.ResponseRecorder, Reply) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/exec", strings.NewReader(job))
+		if version != "" {
+			req.Header.Set("Api-Version", version)
+		}
+		handler.ServeHTTP(rec, req)
+		var reply Reply
+		json.Unmarshal(rec.Body.Bytes(), &reply)
+		return rec, reply
+	}
+
+	// Legacy status codes
+	rec, _ := run("", `{"cmd":"true"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code, "legacy api should reply 202 for completed commands")
+	rec, reply := run("", `{"cmd":"sleep 5","timeout":1}`)
+	assert.Equal(t, 524, rec.Code, "legacy api should reply 524 on timeouts")
+	assert.True(t, reply.Timeout, "timeout should be flagged")
+	rec, _ = run("", `{"cmd":"nonexisting-command-1234"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "legacy api should reply 400 for failed commands")
+
+	// Version 1 status codes
+	rec, reply = run("1", `{"cmd":"false"}`)
+	assert.Equal(t, http.StatusOK, rec.Code, "completed commands should reply 200")
+	assert.Equal(t, 1, reply.ReturnCode, "return code should be in the reply")
+	assert.False(t, reply.Timeout)
+	rec, reply = run("1", `{"cmd":"sleep 5","timeout":1}`)
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code, "timeouts should reply 504")
+	assert.True(t, reply.Timeout, "timeout should be flagged")
+	rec, _ = run("1", `{"cmd":"nonexisting-command-1234"}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "missing executables should reply 404")
+	assert.Equal(t, ERR_NOT_FOUND, decodeError(t, rec).Code)
+}
+
+func TestFileRange(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "image.iso")
+	assert.NoError(t, os.WriteFile(filename, []byte("0123456789abcdef"), 0644))
+	var cf Config
+	cf.SetDefaults()
+	handler := getFileHandler(cf)
+
+	request := func(header http.Header) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/file?"+url.Values{"path": {filename}}.Encode(), nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		handler.ServeHTTP(rec, withAPIVersion(req, API_V1))
+		return rec
+	}
+
+	// Full request
+	rec := request(nil)
+	assert.Equal(t, http.StatusOK, rec.Code, "file request should succeed")
+	assert.Equal(t, "0123456789abcdef", rec.Body.String())
+	assert.Equal(t, "bytes", rec.Header().Get("Accept-Ranges"), "ranges should be announced")
+	assert.NotEmpty(t, rec.Header().Get("Last-Modified"), "Last-Modified should be set")
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag, "ETag should be set")
+
+	// Range requests
+	rec = request(http.Header{"Range": {"bytes=10-"}})
+	assert.Equal(t, http.StatusPartialContent, rec.Code, "range request should return partial content")
+	assert.Equal(t, "abcdef", rec.Body.String())
+	assert.Equal(t, "bytes 10-15/16", rec.Header().Get("Content-Range"))
+	rec = request(http.Header{"Range": {"bytes=2-4"}, "If-Range": {etag}})
+	assert.Equal(t, http.StatusPartialContent, rec.Code, "range request with matching If-Range should return partial content")
+	assert.Equal(t, "234", rec.Body.String())
+	rec = request(http.Header{"Range": {"bytes=2-4"}, "If-Range": {"\"outdated\""}})
+	assert.Equal(t, http.StatusOK, rec.Code, "range request with outdated If-Range should return the whole file")
+	assert.Equal(t, "0123456789abcdef", rec.Body.String())
+	rec = request(http.Header{"Range": {"bytes=20-"}})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code, "range beyond the end of file should not be satisfiable")
+
+	// Legacy clients get 202 for full replies
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/file?"+url.Values{"path": {filename}}.Encode(), nil))
+	assert.Equal(t, http.StatusAccepted, rec.Code, "legacy api should reply 202 for files")
+	assert.Equal(t, "0123456789abcdef", rec.Body.String())
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/file?"+url.Values{"path": {filename}}.Encode(), nil)
+	req.Header.Set("Range", "bytes=10-")
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPartialContent, rec.Code, "legacy api should reply 206 for ranges")
+
+	// Directories are not files
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/file?"+url.Values{"path": {t.TempDir()}}.Encode(), nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "directories should be rejected")
+}
+
+func TestFileResume(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "core.dump")
+	var cf Config
+	cf.SetDefaults()
+	handler := putFileHandler(cf)
+
+	upload := func(offset string, data string) *httptest.ResponseRecorder {
+		values := url.Values{"path": {filename}}
+		if offset != "" {
+			values.Set("offset", offset)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/file?"+values.Encode(), bytes.NewBufferString(data)))
+		return rec
+	}
+	content := func() string {
+		data, err := os.ReadFile(filename)
+		assert.NoError(t, err, "reading uploaded file should succeed")
+		return string(data)
+	}
+
+	assert.Equal(t, http.StatusAccepted, upload("", "0123456789").Code, "upload should succeed")
+	assert.Equal(t, "0123456789", content())
+	// Overwriting with a shorter file must not leave any remains
+	assert.Equal(t, http.StatusAccepted, upload("", "01234").Code, "upload should succeed")
+	assert.Equal(t, "01234", content())
+	// Resume at the end and in the middle of the file
+	assert.Equal(t, http.StatusAccepted, upload("5", "56789").Code, "resuming upload should succeed")
+	assert.Equal(t, "0123456789", content())
+	rec := upload("8", "89abcdef")
+	assert.Equal(t, http.StatusAccepted, rec.Code, "resuming upload should succeed")
+	assert.Contains(t, rec.Body.String(), "\"size\":16")
+	assert.Equal(t, "0123456789abcdef", content())
+	// Invalid offsets
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, upload("20", "xyz").Code, "offset beyond the end of file should be rejected")
+	assert.Equal(t, http.StatusBadRequest, upload("-1", "xyz").Code, "negative offset should be rejected")
+	assert.Equal(t, http.StatusBadRequest, upload("abc", "xyz").Code, "invalid offset should be rejected")
+	assert.Equal(t, "0123456789abcdef", content())
+}
+
+func TestFileUploadInPlace(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "file")
+	assert.NoError(t, os.WriteFile(filename, []byte("original content"), 0644))
+	var cf Config
+	cf.SetDefaults()
+	handler := putFileHandler(cf)
+
+	upload := func(path string, data string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/file?"+url.Values{"path": {path}}.Encode(), bytes.NewBufferString(data)))
+		return rec.Code
+	}
+	content := func(path string) string {
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	// Hard links and symlinks must be kept
+	hardlink := filepath.Join(dir, "hardlink")
+	assert.NoError(t, os.Link(filename, hardlink))
+	assert.Equal(t, http.StatusAccepted, upload(hardlink, "hard"))
+	assert.Equal(t, "hard", content(filename), "uploads should be written through hard links")
+	symlink := filepath.Join(dir, "symlink")
+	assert.NoError(t, os.Symlink(filename, symlink))
+	assert.Equal(t, http.StatusAccepted, upload(symlink, "soft"))
+	assert.Equal(t, "soft", content(filename), "uploads should be written to the target of symlinks")
+	info, err := os.Lstat(symlink)
+	assert.NoError(t, err)
+	assert.NotZero(t, info.Mode()&os.ModeSymlink, "symlinks should not be replaced")
+
+	// Dangling symlinks must not allow to create files outside of the allowed paths
+	allowed := filepath.Join(dir, "allowed")
+	assert.NoError(t, os.Mkdir(allowed, 0755))
+	assert.NoError(t, os.Symlink(filepath.Join(dir, "pwned"), filepath.Join(allowed, "link")))
+	cf.Webserver.Files.WriteAllow = []string{allowed}
+	handler = putFileHandler(cf)
+	assert.Equal(t, http.StatusForbidden, upload(filepath.Join(allowed, "link"), "pwned"), "dangling symlinks pointing outside should be denied")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/file?"+url.Values{"path": {filepath.Join(allowed, "link")}, "offset": {"0"}}.Encode(), bytes.NewBufferString("pwned")))
+	assert.Equal(t, http.StatusForbidden, rec.Code, "resumed uploads via dangling symlinks pointing outside should be denied")
+	assert.NoFileExists(t, filepath.Join(dir, "pwned"))
+	cf.Webserver.Files.WriteAllow = nil
+	handler = putFileHandler(cf)
+
+	// Device nodes must not be replaced by regular files
+	if info, err := os.Stat(os.DevNull); err == nil && info.Mode()&os.ModeDevice != 0 {
+		assert.Equal(t, http.StatusAccepted, upload(os.DevNull, "discarded"))
+		info, err := os.Stat(os.DevNull)
+		assert.NoError(t, err)
+		assert.NotZero(t, info.Mode()&os.ModeDevice, "device nodes should be written in place")
+	}
+}
+
+func TestFileUploadErrors(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "upload")
+	assert.NoError(t, os.WriteFile(filename, []byte("original"), 0600))
+	var cf Config
+	cf.SetDefaults()
+	handler := putFileHandler(cf)
+
+	upload := func(path string, offset string, body io.Reader) *httptest.ResponseRecorder {
+		values := url.Values{"path": {path}}
+		if offset != "" {
+			values.Set("offset", offset)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/file?"+values.Encode(), body))
+		return rec
+	}
+	// Simulates a client disconnecting mid-upload
+	disconnect := func(data string) io.Reader {
+		return io.MultiReader(strings.NewReader(data), iotest.ErrReader(io.ErrUnexpectedEOF))
+	}
+
+	rec := upload(filename, "", disconnect("partial"))
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "interrupted upload should fail")
+	assert.Equal(t, ERR_RECEIVE_FAILED, decodeError(t, rec).Code)
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "original", string(data), "interrupted upload must not modify the destination")
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "no partial files should remain")
+
+	rec = upload(filepath.Join(dir, "nonexisting", "upload"), "", strings.NewReader("data"))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code, "write errors should fail the request")
+
+	// Interrupted resumed uploads keep the received data, so that they can be resumed again
+	rec = upload(filename, "8", disconnect("-resumed"))
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "interrupted upload should fail")
+	assert.Contains(t, rec.Body.String(), "\"size\":16")
+	data, err = os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "original-resumed", string(data))
+
+	// Overwriting keeps the permissions of the existing file
+	assert.Equal(t, http.StatusAccepted, upload(filename, "", strings.NewReader("overwritten")).Code)
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "permissions should be kept")
+
+	// Version 1 replies 200 for completed uploads
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/file?"+url.Values{"path": {filename}}.Encode(), strings.NewReader("versioned"))
+	req.Header.Set("Api-Version", "1")
+	apiVersionHandler(handler).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestFileAccessDenied(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "shadow")
+	assert.NoError(t, os.WriteFile(filename, []byte("secret"), 0600))
+
+	var cf Config
+	cf.SetDefaults()
+	cf.Webserver.Files.ReadDeny = []string{dir}
+	cf.Webserver.Files.WriteDeny = []string{dir}
+
+	rec := httptest.NewRecorder()
+	getFileHandler(cf).ServeHTTP(rec, httptest.NewRequest("GET", "/file?"+url.Values{"path": {filename}}.Encode(), nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code, "reading denied paths should be forbidden")
+	assert.NotContains(t, rec.Body.String(), "secret")
+
+	rec = httptest.NewRecorder()
+	putFileHandler(cf).ServeHTTP(rec, httptest.NewRequest("POST", "/file?"+url.Values{"path": {filename}}.Encode(), bytes.NewBufferString("overwritten")))
+	assert.Equal(t, http.StatusForbidden, rec.Code, "writing denied paths should be forbidden")
+	data, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", string(data), "denied file must not be modified")
+}